@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kiwiirc/plugin-fileuploader/server"
+)
+
+func banCommand(configPath string, overrides server.Overrides, args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: ban add|remove|list")
+	}
+
+	flags := flag.NewFlagSet("ban "+args[0], flag.ExitOnError)
+	reason := flags.String("reason", "", "why the range is banned")
+	actor := flags.String("actor", currentUsername(), "who placed the ban")
+	duration := flags.Duration("duration", 0, "lift the ban after this long, permanent when 0")
+	terminate := flags.Bool("terminate", false, "delete existing uploads from the range")
+	flags.Parse(args[1:])
+
+	mc, err := server.NewMaintenanceContext(configPath, overrides)
+	if err != nil {
+		return err
+	}
+	defer mc.Close()
+
+	switch args[0] {
+	case "add":
+		if flags.NArg() != 1 {
+			return errors.New("Usage: ban add [--reason <reason>] [--duration <d>] [--terminate] <ip|cidr>")
+		}
+		network, err := server.ParseBanRange(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+
+		var expiresAt time.Time
+		if *duration > 0 {
+			expiresAt = time.Now().Add(*duration)
+		}
+		if err := mc.Store.AddBan(network, *reason, *actor, expiresAt); err != nil {
+			return err
+		}
+
+		if *terminate {
+			terminated, err := mc.Store.TerminateUploadsFrom(network)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Terminated %d uploads from %s\n", len(terminated), network)
+		}
+		return nil
+
+	case "remove":
+		if flags.NArg() != 1 {
+			return errors.New("Usage: ban remove <ip|cidr>")
+		}
+		network, err := server.ParseBanRange(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		return mc.Store.RemoveBan(network)
+
+	case "list":
+		bans, err := mc.Store.ListBans()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "RANGE\tCREATED\tEXPIRES\tACTOR\tREASON")
+		for _, ban := range bans {
+			expires := "never"
+			if ban.ExpiresAt != nil {
+				expires = time.Unix(*ban.ExpiresAt, 0).Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				ban.CIDR,
+				time.Unix(ban.CreatedAt, 0).Format(time.RFC3339),
+				expires,
+				ban.Actor,
+				ban.Reason,
+			)
+		}
+		return w.Flush()
+
+	default:
+		return fmt.Errorf("Unknown ban subcommand %#v", args[0])
+	}
+}
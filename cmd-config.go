@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/kiwiirc/plugin-fileuploader/server"
+)
+
+func configCommand(configPath string, overrides server.Overrides, args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: config check|show")
+	}
+
+	switch args[0] {
+	case "check":
+		_, err := server.LoadConfig(configPath, overrides)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: OK\n", configPath)
+		return nil
+
+	case "show":
+		// shown without validation, to help finding out why a config is invalid
+		cfg := server.NewConfig()
+		if _, err := cfg.Load(configPath, overrides); err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+		for _, setting := range cfg.Settings() {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", setting.Key, setting.Value, setting.Source)
+		}
+		return w.Flush()
+	}
+
+	return fmt.Errorf("Unknown config command %#v", args[0])
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/kiwiirc/plugin-fileuploader/expirer"
+	"github.com/kiwiirc/plugin-fileuploader/server"
+)
+
+func expireCommand(configPath string, overrides server.Overrides, args []string) error {
+	flags := flag.NewFlagSet("expire", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report uploads that would expire without deleting them")
+	maxAge := flags.Duration("max-age", 0, "override Expiration.MaxAge")
+	identifiedMaxAge := flags.Duration("identified-max-age", 0, "override Expiration.IdentifiedMaxAge")
+	flags.Parse(args)
+
+	mc, err := server.NewMaintenanceContext(configPath, overrides)
+	if err != nil {
+		return err
+	}
+	defer mc.Close()
+
+	report, err := mc.Expirer.Run(expirer.RunOptions{
+		DryRun:           *dryRun,
+		ListUploads:      true,
+		MaxAge:           *maxAge,
+		IdentifiedMaxAge: *identifiedMaxAge,
+	})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCREATED\tACCOUNT\tSIZE")
+	for _, upload := range report.Uploads {
+		account := "-"
+		if upload.Account != nil {
+			account = *upload.Account
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+			upload.ID,
+			time.Unix(upload.CreatedAt, 0).Format(time.RFC3339),
+			account,
+			datasize.ByteSize(upload.Size).HR(),
+		)
+	}
+	w.Flush()
+
+	verb := "Expired"
+	if report.DryRun {
+		verb = "Would expire"
+	}
+	fmt.Printf("\n%s %d uploads, %s (%d bytes)\n", verb, report.Count, datasize.ByteSize(report.Bytes).HR(), report.Bytes)
+	if report.Failed > 0 {
+		return fmt.Errorf("Failed to terminate %d uploads", report.Failed)
+	}
+	return nil
+}
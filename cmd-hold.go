@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kiwiirc/plugin-fileuploader/server"
+)
+
+func holdCommand(configPath string, overrides server.Overrides, args []string) error {
+	if len(args) == 0 {
+		return errors.New("Usage: hold set|clear|list")
+	}
+
+	flags := flag.NewFlagSet("hold "+args[0], flag.ExitOnError)
+	reason := flags.String("reason", "", "why the upload is held (required for set)")
+	actor := flags.String("actor", currentUsername(), "who placed the hold")
+	flags.Parse(args[1:])
+
+	mc, err := server.NewMaintenanceContext(configPath, overrides)
+	if err != nil {
+		return err
+	}
+	defer mc.Close()
+
+	switch args[0] {
+	case "set":
+		if flags.NArg() != 1 || *reason == "" {
+			return errors.New("Usage: hold set --reason <reason> [--actor <name>] <id>")
+		}
+		return mc.Store.SetHold(flags.Arg(0), *reason, *actor)
+
+	case "clear":
+		if flags.NArg() != 1 {
+			return errors.New("Usage: hold clear <id>")
+		}
+		return mc.Store.ClearHold(flags.Arg(0))
+
+	case "list":
+		holds, err := mc.Store.ListHolds()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tHELD AT\tACTOR\tNICK\tCHANNEL\tDELETED\tREASON")
+		for _, hold := range holds {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%s\n",
+				hold.ID,
+				time.Unix(hold.HeldAt, 0).Format(time.RFC3339),
+				hold.Actor,
+				hold.Nick,
+				hold.Channel,
+				hold.Deleted,
+				hold.Reason,
+			)
+		}
+		return w.Flush()
+
+	default:
+		return fmt.Errorf("Unknown hold subcommand %#v", args[0])
+	}
+}
+
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "cli"
+}
@@ -65,3 +65,11 @@ func UpdateRow(db *sqlx.DB, query string, args ...interface{}) (err error) {
 	}
 	return
 }
+
+// StringValue returns the value scanned from a nullable text column, or "" for NULL
+func StringValue(str *string) string {
+	if str == nil {
+		return ""
+	}
+	return *str
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package expirer
+
+import "errors"
+
+func diskUsage(path string) (float64, error) {
+	return 0, errors.New("Disk usage reporting is not supported on this platform")
+}
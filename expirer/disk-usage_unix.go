@@ -0,0 +1,34 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package expirer
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// diskUsage returns the fraction (0-1) of the volume containing path that is in use,
+// as seen by unprivileged users. Non-existent paths resolve to their nearest existing parent.
+func diskUsage(path string) (float64, error) {
+	var stat syscall.Statfs_t
+	for {
+		err := syscall.Statfs(path, &stat)
+		if err == nil {
+			break
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return 0, err
+		}
+		path = parent
+	}
+
+	used := stat.Blocks - stat.Bfree
+	total := used + stat.Bavail
+	if total == 0 {
+		return 0, nil
+	}
+	return float64(used) / float64(total), nil
+}
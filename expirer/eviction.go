@@ -0,0 +1,137 @@
+package expirer
+
+import (
+	"fmt"
+
+	"github.com/kiwiirc/plugin-fileuploader/metrics"
+)
+
+// how many eviction candidates are fetched from the database at a time
+const evictionBatchSize = 100
+
+type evictionCandidate struct {
+	ID         string `db:"id"`
+	Identified bool   `db:"identified"`
+}
+
+// EnsureFreeSpace evicts uploads while disk usage of the store volume is above the
+// high watermark, until it drops below the low watermark. Anonymous uploads are
+// evicted before identified ones, and incomplete uploads, which may still be written
+// to, are not evicted. ErrInsufficientStorage is returned if usage could not be
+// brought back under the high watermark.
+func (expirer *Expirer) EnsureFreeSpace() error {
+	if expirer.highWatermark <= 0 {
+		return nil
+	}
+
+	used, err := diskUsage(expirer.store.BasePath)
+	if err != nil || used < expirer.highWatermark {
+		return err
+	}
+
+	expirer.evictionMu.Lock()
+	defer expirer.evictionMu.Unlock()
+
+	// another eviction pass may have freed space while we were waiting
+	used, err = diskUsage(expirer.store.BasePath)
+	if err != nil || used < expirer.highWatermark {
+		return err
+	}
+
+	expirer.log.Warn().
+		Str("event", "disk_pressure").
+		Float64("diskUsage", used).
+		Float64("highWatermark", expirer.highWatermark).
+		Msg("Disk usage above high watermark, evicting uploads")
+
+	used, err = expirer.evict(used)
+	if err != nil {
+		return err
+	}
+
+	if used >= expirer.highWatermark {
+		expirer.log.Error().
+			Str("event", "disk_pressure").
+			Float64("diskUsage", used).
+			Float64("highWatermark", expirer.highWatermark).
+			Msg("Eviction could not free enough space")
+		return ErrInsufficientStorage
+	}
+
+	return nil
+}
+
+// evict terminates uploads in eviction order until disk usage drops below the low
+// watermark or no candidates remain. Returns the resulting disk usage.
+func (expirer *Expirer) evict(used float64) (float64, error) {
+	failed := 0
+	for used >= expirer.lowWatermark && !expirer.stopped() {
+		candidates, err := expirer.getEvictionCandidates(failed)
+		if err != nil {
+			return used, err
+		}
+		if len(candidates) == 0 {
+			return used, nil
+		}
+
+		for _, candidate := range candidates {
+			if expirer.stopped() {
+				break
+			}
+
+			err = expirer.store.Terminate(candidate.ID)
+			if err != nil {
+				failed++
+				expirer.log.Error().
+					Err(err).
+					Str("id", candidate.ID).
+					Msg("Failed to terminate evicted upload")
+				continue
+			}
+
+			metrics.EvictedUploads.Add(1)
+			expirer.log.Info().
+				Str("event", "evicted").
+				Str("id", candidate.ID).
+				Str("reason", "disk_pressure").
+				Str("order", expirer.evictionOrder).
+				Bool("identified", candidate.Identified).
+				Float64("diskUsage", used).
+				Msg("Evicted upload id")
+
+			used, err = diskUsage(expirer.store.BasePath)
+			if err != nil {
+				return used, err
+			}
+			if used < expirer.lowWatermark {
+				break
+			}
+		}
+	}
+	return used, nil
+}
+
+// getEvictionCandidates returns the next batch of uploads to evict, skipping the
+// given number of leading candidates that previously failed to terminate
+func (expirer *Expirer) getEvictionCandidates(skip int) (candidates []evictionCandidate, err error) {
+	var order string
+	switch expirer.evictionOrder {
+	case EvictLeastRecentlyDownloaded:
+		order = "COALESCE(last_downloaded_at, created_at)"
+	case EvictOldest, "":
+		order = "created_at"
+	default:
+		return nil, fmt.Errorf("Unknown eviction order %#v", expirer.evictionOrder)
+	}
+
+	err = expirer.store.DBConn.DB.Select(&candidates, `
+		SELECT id, jwt_account IS NOT NULL AS identified FROM uploads
+		WHERE deleted = 0 AND held = 0 AND sha256sum IS NOT NULL
+		ORDER BY identified, `+order+`, id
+		LIMIT ? OFFSET ?
+		`,
+		evictionBatchSize,
+		skip,
+	)
+	return
+}
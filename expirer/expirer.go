@@ -1,33 +1,123 @@
 package expirer
 
 import (
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/metrics"
+	"github.com/kiwiirc/plugin-fileuploader/policy"
 	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
 	"github.com/rs/zerolog"
 )
 
+// ErrInsufficientStorage occurs when disk usage remains above the high watermark after eviction
+var ErrInsufficientStorage = errors.New("Insufficient free storage space")
+
+// ErrRunInProgress occurs when a collection is requested while another is still running
+var ErrRunInProgress = errors.New("Expiration run already in progress")
+
+// ErrStopped occurs when a collection is requested or interrupted by Expirer.Stop
+var ErrStopped = errors.New("Expirer stopped")
+
+// Eviction orders accepted by Config.EvictionOrder
+const (
+	EvictOldest                  = "oldest"
+	EvictLeastRecentlyDownloaded = "least-recently-downloaded"
+)
+
+// Config holds the settings used by an Expirer
+type Config struct {
+	MaxAge             time.Duration
+	IdentifiedMaxAge   time.Duration
+	CheckInterval      time.Duration // periodic collection is disabled when zero
+	JwtSecretsByIssuer map[string]string
+	Policies           []policy.Policy // override MaxAge and IdentifiedMaxAge for matching uploads
+	BatchSize          int             // expired uploads fetched per page
+	Concurrency        int             // uploads terminated in parallel
+
+	// Disk usage fractions (0-1) of the volume holding the store. Eviction is
+	// disabled when HighWatermark is zero.
+	HighWatermark float64
+	LowWatermark  float64
+	EvictionOrder string
+}
+
 type Expirer struct {
 	ticker             *time.Ticker
 	store              *shardedfilestore.ShardedFileStore
 	maxAge             time.Duration
 	identifiedMaxAge   time.Duration
+	policies           []policy.Policy
 	jwtSecretsByIssuer map[string]string
-	quitChan           chan struct{} // closes when ticker has been stopped
+	highWatermark      float64
+	lowWatermark       float64
+	evictionOrder      string
+	batchSize          int
+	concurrency        int
+	running            int32          // set atomically while a collection run is in progress
+	runWg              sync.WaitGroup // tracks the collection run so Stop can wait for it
+	stopMu             sync.Mutex     // orders runWg.Add against Stop closing quitChan
+	evictionMu         sync.Mutex     // held while evicting to avoid concurrent passes
+	quitChan           chan struct{}  // closes when ticker has been stopped
 	log                *zerolog.Logger
 }
 
-func New(store *shardedfilestore.ShardedFileStore, maxAge, identifiedMaxAge, checkInterval time.Duration, jwtSecretsByIssuer map[string]string, log *zerolog.Logger) *Expirer {
+// RunOptions adjusts a single collection run
+type RunOptions struct {
+	DryRun bool
+
+	// List affected uploads in the report. Always enabled for dry runs.
+	ListUploads bool
+
+	// Override the configured default ages when non-zero. Matching policies still apply.
+	MaxAge           time.Duration
+	IdentifiedMaxAge time.Duration
+}
+
+// ExpiredUpload describes an upload selected for expiration
+type ExpiredUpload struct {
+	ID        string  `db:"id" json:"id"`
+	CreatedAt int64   `db:"created_at" json:"createdAt"`
+	Issuer    *string `db:"jwt_issuer" json:"issuer,omitempty"`
+	Account   *string `db:"jwt_account" json:"account,omitempty"`
+	MimeType  *string `db:"mime_type" json:"type,omitempty"`
+	Size      int64   `db:"-" json:"size"`
+}
+
+// Report summarizes the outcome of a collection run
+type Report struct {
+	DryRun  bool            `json:"dryRun"`
+	Count   int             `json:"count"`
+	Bytes   int64           `json:"bytes"`
+	Failed  int             `json:"failed"`
+	Uploads []ExpiredUpload `json:"uploads"`
+}
+
+func New(store *shardedfilestore.ShardedFileStore, cfg Config, log *zerolog.Logger) *Expirer {
 	expirer := &Expirer{
-		ticker:             time.NewTicker(checkInterval),
 		store:              store,
-		maxAge:             maxAge,
-		identifiedMaxAge:   identifiedMaxAge,
-		jwtSecretsByIssuer: jwtSecretsByIssuer,
+		maxAge:             cfg.MaxAge,
+		identifiedMaxAge:   cfg.IdentifiedMaxAge,
+		policies:           cfg.Policies,
+		jwtSecretsByIssuer: cfg.JwtSecretsByIssuer,
+		highWatermark:      cfg.HighWatermark,
+		lowWatermark:       cfg.LowWatermark,
+		evictionOrder:      cfg.EvictionOrder,
+		batchSize:          cfg.BatchSize,
+		concurrency:        cfg.Concurrency,
 		quitChan:           make(chan struct{}),
 		log:                log,
 	}
 
+	if cfg.CheckInterval <= 0 {
+		return expirer
+	}
+
+	expirer.ticker = time.NewTicker(cfg.CheckInterval)
+
 	go func() {
 		for {
 			select {
@@ -50,9 +140,24 @@ func New(store *shardedfilestore.ShardedFileStore, maxAge, identifiedMaxAge, che
 }
 
 // Stop turns off an Expirer. No more Filestore garbage collection cycles will start.
+// A run in progress is interrupted, Stop returns once it has wound down.
 func (expirer *Expirer) Stop() {
-	expirer.ticker.Stop()
+	if expirer.ticker != nil {
+		expirer.ticker.Stop()
+	}
+	expirer.stopMu.Lock()
 	close(expirer.quitChan)
+	expirer.stopMu.Unlock()
+	expirer.runWg.Wait()
+}
+
+func (expirer *Expirer) stopped() bool {
+	select {
+	case <-expirer.quitChan:
+		return true
+	default:
+		return false
+	}
 }
 
 func (expirer *Expirer) gc(t time.Time) {
@@ -60,57 +165,244 @@ func (expirer *Expirer) gc(t time.Time) {
 		Str("event", "gc_tick").
 		Msg("Filestore GC tick")
 
-	expiredIds, err := expirer.getExpired()
-	if err != nil {
+	_, err := expirer.Run(RunOptions{})
+	if err == ErrRunInProgress {
+		expirer.log.Warn().
+			Str("event", "gc_skipped").
+			Msg("Previous expiration run still in progress, skipping tick")
+		return
+	}
+	if err != nil && err != ErrStopped {
 		expirer.log.Error().
 			Err(err).
 			Msg("Failed to enumerate expired uploads")
-		return
+	}
+}
+
+// Run performs a collection immediately: expired uploads are terminated, followed by
+// disk-pressure eviction. With DryRun set, nothing is deleted and the report lists the
+// uploads that would have expired. Only one run can be in progress at a time.
+func (expirer *Expirer) Run(opts RunOptions) (*Report, error) {
+	if !atomic.CompareAndSwapInt32(&expirer.running, 0, 1) {
+		return nil, ErrRunInProgress
+	}
+	defer atomic.StoreInt32(&expirer.running, 0)
+
+	expirer.stopMu.Lock()
+	if expirer.stopped() {
+		expirer.stopMu.Unlock()
+		return nil, ErrStopped
+	}
+	expirer.runWg.Add(1)
+	expirer.stopMu.Unlock()
+	defer expirer.runWg.Done()
+
+	start := time.Now()
+	metrics.ExpiryRuns.Add(1)
+	metrics.ExpiryRunning.Set(1)
+	metrics.ExpiryProcessed.Set(0)
+	defer func() {
+		metrics.ExpiryRunning.Set(0)
+		metrics.ExpiryLastDuration.Set(time.Since(start).Seconds())
+	}()
+
+	policies := policy.Table{
+		Defaults: policy.Limits{
+			MaxAge:           expirer.maxAge,
+			IdentifiedMaxAge: expirer.identifiedMaxAge,
+		},
+		Policies: expirer.policies,
+	}
+	if opts.MaxAge != 0 {
+		policies.Defaults.MaxAge = opts.MaxAge
+	}
+	if opts.IdentifiedMaxAge != 0 {
+		policies.Defaults.IdentifiedMaxAge = opts.IdentifiedMaxAge
 	}
 
-	for _, id := range expiredIds {
-		err = expirer.store.Terminate(id)
+	report := &Report{
+		DryRun:  opts.DryRun,
+		Uploads: []ExpiredUpload{},
+	}
+
+	var cursor *ExpiredUpload
+	for page := 1; ; page++ {
+		if expirer.stopped() {
+			return report, ErrStopped
+		}
+
+		candidates, expired, err := expirer.getExpired(&policies, cursor, start)
 		if err != nil {
-			expirer.log.Error().
-				Err(err).
-				Msg("Failed to terminate expired upload")
-			continue
+			return report, err
+		}
+		if len(candidates) == 0 {
+			break
+		}
+		cursor = &candidates[len(candidates)-1]
+		metrics.ExpiryProcessed.Add(int64(len(candidates)))
+
+		expirer.processExpired(expired, opts, report)
+
+		logEvent := expirer.log.Debug()
+		if len(expired) > 0 {
+			logEvent = expirer.log.Info()
 		}
-		expirer.log.Info().
-			Str("event", "expired").
-			Str("id", id).
-			Msg("Terminated upload id")
+		logEvent.
+			Str("event", "gc_progress").
+			Int("page", page).
+			Int("count", report.Count).
+			Int64("bytes", report.Bytes).
+			Int("failed", report.Failed).
+			Msg("Expiration progress")
+	}
+
+	expirer.log.Info().
+		Str("event", "gc_complete").
+		Bool("dryRun", opts.DryRun).
+		Int("count", report.Count).
+		Int64("bytes", report.Bytes).
+		Int("failed", report.Failed).
+		Dur("duration", time.Since(start)).
+		Msg("Expiration run complete")
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	if _, err := expirer.store.PurgeTokenIDs(start); err != nil {
+		expirer.log.Error().
+			Err(err).
+			Msg("Failed to purge expired token IDs")
 	}
+
+	if _, err := expirer.store.PurgeExpiredBans(start); err != nil {
+		expirer.log.Error().
+			Err(err).
+			Msg("Failed to purge expired bans")
+	}
+
+	if err := expirer.EnsureFreeSpace(); err != nil && err != ErrInsufficientStorage {
+		expirer.log.Error().
+			Err(err).
+			Msg("Failed to check disk usage")
+	}
+
+	return report, nil
 }
 
-func (expirer *Expirer) getExpired() (expiredIds []string, err error) {
-	switch expirer.store.DBConn.DBConfig.DriverName {
-	case "sqlite3":
-		err = expirer.store.DBConn.DB.Select(&expiredIds, `
-			SELECT id FROM uploads
-			WHERE
-				CAST(strftime('%s', 'now') AS INTEGER) -- current time
-				>=
-				created_at + (CASE WHEN jwt_account IS NULL THEN $1 ELSE $2 END) -- expiration time
-			AND deleted != 1
-			`,
-			expirer.maxAge.Seconds(),
-			expirer.identifiedMaxAge.Seconds(),
-		)
-	case "mysql":
-		err = expirer.store.DBConn.DB.Select(&expiredIds, `
-			SELECT id FROM uploads
-			WHERE
-				UNIX_TIMESTAMP() -- current time
-				>=
-				created_at + (CASE WHEN jwt_account IS NULL THEN ? ELSE ? END) -- expiration time
+// processExpired terminates a page of expired uploads using a bounded pool of workers
+func (expirer *Expirer) processExpired(expired []ExpiredUpload, opts RunOptions, report *Report) {
+	concurrency := expirer.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var reportMu sync.Mutex
+	var wg sync.WaitGroup
+	uploads := make(chan ExpiredUpload)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for upload := range uploads {
+				if info, err := expirer.store.GetInfo(upload.ID); err == nil {
+					upload.Size = info.Offset
+				}
+
+				if !opts.DryRun {
+					err := expirer.store.Terminate(upload.ID)
+					if err != nil {
+						metrics.ExpiryFailures.Add(1)
+						reportMu.Lock()
+						report.Failed++
+						reportMu.Unlock()
+						expirer.log.Error().
+							Err(err).
+							Str("id", upload.ID).
+							Msg("Failed to terminate expired upload")
+						continue
+					}
+					metrics.ExpiredUploads.Add(1)
+					metrics.ExpiredBytes.Add(upload.Size)
+					expirer.log.Info().
+						Str("event", "expired").
+						Str("id", upload.ID).
+						Msg("Terminated upload id")
+				}
+
+				reportMu.Lock()
+				report.Count++
+				report.Bytes += upload.Size
+				if opts.DryRun || opts.ListUploads {
+					report.Uploads = append(report.Uploads, upload)
+				}
+				reportMu.Unlock()
+			}
+		}()
+	}
+
+	for _, upload := range expired {
+		if expirer.stopped() {
+			break
+		}
+		uploads <- upload
+	}
+	close(uploads)
+	wg.Wait()
+}
+
+// getExpired fetches the page of candidates following the cursor, ordered by creation
+// time, and returns them along with the subset that has outlived the maximum age of
+// its policy
+func (expirer *Expirer) getExpired(policies *policy.Table, cursor *ExpiredUpload, now time.Time) (candidates, expired []ExpiredUpload, err error) {
+	batchSize := expirer.batchSize
+	if batchSize < 1 {
+		batchSize = 500
+	}
+
+	// start before the oldest possible upload on the first page
+	cursorCreatedAt, cursorID := int64(-1), ""
+	if cursor != nil {
+		cursorCreatedAt, cursorID = cursor.CreatedAt, cursor.ID
+	}
+
+	// narrow down the candidates to those older than the shortest age any policy allows
+	err = expirer.store.DBConn.DB.Select(&candidates, `
+		SELECT id, created_at, jwt_issuer, jwt_account, mime_type FROM uploads
+		WHERE
+			(
+				(jwt_account IS NULL AND created_at <= ?)
+				OR
+				(jwt_account IS NOT NULL AND created_at <= ?)
+			)
 			AND deleted != 1
-			`,
-			expirer.maxAge.Seconds(),
-			expirer.identifiedMaxAge.Seconds(),
+			AND held = 0
+			AND (created_at > ? OR (created_at = ? AND id > ?))
+		ORDER BY created_at, id
+		LIMIT ?
+		`,
+		now.Add(-policies.ShortestMaxAge(false)).Unix(),
+		now.Add(-policies.ShortestMaxAge(true)).Unix(),
+		cursorCreatedAt,
+		cursorCreatedAt,
+		cursorID,
+		batchSize,
+	)
+	if err != nil {
+		return
+	}
+
+	for _, candidate := range candidates {
+		limits := policies.Lookup(
+			db.StringValue(candidate.Issuer),
+			db.StringValue(candidate.Account),
+			db.StringValue(candidate.MimeType),
 		)
-	default:
-		panic("Unhandled database driver")
+		maxAge := limits.MaxAgeFor(candidate.Account != nil)
+		if !now.Before(time.Unix(candidate.CreatedAt, 0).Add(maxAge)) {
+			expired = append(expired, candidate)
+		}
 	}
 
 	return
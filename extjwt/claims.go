@@ -0,0 +1,126 @@
+package extjwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Validation configures the checks applied to the registered claims of a token
+type Validation struct {
+	// The aud claim must contain one of these values when set. Can be overridden per
+	// issuer with SetAudience.
+	Audience []string
+
+	// Clock skew tolerated when checking exp, nbf and iat
+	Leeway time.Duration
+}
+
+// NumericDate reads a claim holding seconds since the epoch. ok is false if the claim
+// is absent.
+func NumericDate(claims jwt.MapClaims, name string) (t time.Time, ok bool, err error) {
+	value, present := claims[name]
+	if !present {
+		return time.Time{}, false, nil
+	}
+
+	var seconds float64
+	switch v := value.(type) {
+	case float64:
+		seconds = v
+	case json.Number:
+		seconds, err = v.Float64()
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("Claim %#v is not a number", name)
+		}
+	default:
+		return time.Time{}, false, fmt.Errorf("Claim %#v is not a number", name)
+	}
+
+	return time.Unix(int64(seconds), 0), true, nil
+}
+
+// Joined reads the "joined" claim of a channel token. It holds the time the user joined
+// the channel, or zero when they are not in it. Some issuers, such as webircgateway,
+// give a boolean instead. ok is false if the claim is absent.
+func Joined(claims jwt.MapClaims) (joined bool, ok bool, err error) {
+	if value, isBool := claims["joined"].(bool); isBool {
+		return value, true, nil
+	}
+	t, ok, err := NumericDate(claims, "joined")
+	return ok && t.Unix() != 0, ok, err
+}
+
+// StringsClaim reads a claim holding either a single string or an array of strings
+func StringsClaim(claims jwt.MapClaims, name string) ([]string, error) {
+	switch v := claims[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("Claim %#v contains a non-string value", name)
+			}
+			values = append(values, str)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("Claim %#v is not a string or array of strings", name)
+	}
+}
+
+func (v *Verifier) validateClaims(claims jwt.MapClaims, now time.Time) error {
+	leeway := v.validation.Leeway
+
+	exp, ok, err := NumericDate(claims, "exp")
+	if err != nil {
+		return jwt.NewValidationError(err.Error(), jwt.ValidationErrorMalformed)
+	}
+	if ok && now.After(exp.Add(leeway)) {
+		return jwt.NewValidationError("Token is expired", jwt.ValidationErrorExpired)
+	}
+
+	nbf, ok, err := NumericDate(claims, "nbf")
+	if err != nil {
+		return jwt.NewValidationError(err.Error(), jwt.ValidationErrorMalformed)
+	}
+	if ok && now.Add(leeway).Before(nbf) {
+		return jwt.NewValidationError("Token is not valid yet", jwt.ValidationErrorNotValidYet)
+	}
+
+	iat, ok, err := NumericDate(claims, "iat")
+	if err != nil {
+		return jwt.NewValidationError(err.Error(), jwt.ValidationErrorMalformed)
+	}
+	if ok && now.Add(leeway).Before(iat) {
+		return jwt.NewValidationError("Token used before issued", jwt.ValidationErrorIssuedAt)
+	}
+
+	issuer, _ := claims["iss"].(string)
+	audience := v.validation.Audience
+	if iss, ok := v.issuers[issuer]; ok && iss.Audience != nil {
+		audience = iss.Audience
+	}
+	if len(audience) == 0 {
+		return nil
+	}
+
+	aud, err := StringsClaim(claims, "aud")
+	if err != nil {
+		return jwt.NewValidationError(err.Error(), jwt.ValidationErrorMalformed)
+	}
+	for _, accepted := range audience {
+		for _, given := range aud {
+			if given == accepted {
+				return nil
+			}
+		}
+	}
+	return jwt.NewValidationError("Token audience not accepted", jwt.ValidationErrorAudience)
+}
@@ -0,0 +1,194 @@
+// Package extjwt verifies EXTJWT tokens issued by IRC networks, using either shared
+// HMAC secrets or public keys.
+package extjwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"golang.org/x/crypto/ed25519"
+)
+
+// ErrNoMatchingKey occurs when no configured key of the issuer fits the token
+var ErrNoMatchingKey = errors.New("No configured key matches the token's alg and kid")
+
+// ErrAmbiguousKey occurs when several keys fit a token that does not specify a kid
+var ErrAmbiguousKey = errors.New("Several configured keys match the token, a kid is required")
+
+// UnknownIssuerError occurs when a token has an issuer that is not present in the config
+type UnknownIssuerError struct {
+	Issuer string
+}
+
+func (e UnknownIssuerError) Error() string {
+	return fmt.Sprintf("Issuer %#v not configured", e.Issuer)
+}
+
+// Key is a public key used to verify tokens
+type Key struct {
+	ID        string // matched against the token's kid header when set
+	Alg       string // restricts the key to a single algorithm when set
+	PublicKey interface{}
+}
+
+func (k *Key) fits(method jwt.SigningMethod) bool {
+	if k.Alg != "" && k.Alg != method.Alg() {
+		return false
+	}
+
+	switch method.(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := k.PublicKey.(*rsa.PublicKey)
+		return ok
+	case *jwt.SigningMethodECDSA:
+		_, ok := k.PublicKey.(*ecdsa.PublicKey)
+		return ok
+	case *SigningMethodEdDSA:
+		_, ok := k.PublicKey.(ed25519.PublicKey)
+		return ok
+	default:
+		return false
+	}
+}
+
+// Issuer holds the verification material for a single token issuer
+type Issuer struct {
+	Secret   []byte // HMAC secret
+	Keys     []Key
+	Audience []string // overrides Validation.Audience when not nil
+}
+
+func (iss *Issuer) keyFor(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(iss.Secret) == 0 {
+			return nil, ErrNoMatchingKey
+		}
+		return iss.Secret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+
+	var candidates []*Key
+	for i := range iss.Keys {
+		key := &iss.Keys[i]
+		if !key.fits(token.Method) {
+			continue
+		}
+		// an exact kid match takes precedence
+		if kid != "" && key.ID == kid {
+			return key.PublicKey, nil
+		}
+		if kid == "" || key.ID == "" {
+			candidates = append(candidates, key)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, ErrNoMatchingKey
+	case 1:
+		return candidates[0].PublicKey, nil
+	default:
+		return nil, ErrAmbiguousKey
+	}
+}
+
+// Verifier selects the key for a token based on its issuer
+type Verifier struct {
+	issuers    map[string]*Issuer
+	validation Validation
+}
+
+// NewVerifier creates an empty Verifier
+func NewVerifier() *Verifier {
+	return &Verifier{
+		issuers: make(map[string]*Issuer),
+	}
+}
+
+func (v *Verifier) issuer(name string) *Issuer {
+	iss, ok := v.issuers[name]
+	if !ok {
+		iss = &Issuer{}
+		v.issuers[name] = iss
+	}
+	return iss
+}
+
+// AddSecret configures the HMAC secret of an issuer
+func (v *Verifier) AddSecret(issuer, secret string) {
+	v.issuer(issuer).Secret = []byte(secret)
+}
+
+// AddKeys adds public keys to an issuer
+func (v *Verifier) AddKeys(issuer string, keys ...Key) {
+	iss := v.issuer(issuer)
+	iss.Keys = append(iss.Keys, keys...)
+}
+
+// SetAudience overrides the audiences accepted from an issuer
+func (v *Verifier) SetAudience(issuer string, audience []string) {
+	v.issuer(issuer).Audience = audience
+}
+
+// SetValidation configures the checks applied to the claims of verified tokens
+func (v *Verifier) SetValidation(validation Validation) {
+	v.validation = validation
+}
+
+// HasIssuer reports whether any verification material is configured for the issuer
+func (v *Verifier) HasIssuer(issuer string) bool {
+	_, ok := v.issuers[issuer]
+	return ok
+}
+
+// Keyfunc looks up the verification key for a token, for use with jwt.Parse
+func (v *Verifier) Keyfunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC, *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA, *SigningMethodEdDSA:
+	default:
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("Failed to get claims")
+	}
+
+	issuer, ok := claims["iss"]
+	if !ok {
+		return nil, fmt.Errorf("Issuer field 'iss' missing from JWT")
+	}
+
+	issuerStr, ok := issuer.(string)
+	if !ok {
+		return nil, fmt.Errorf("Failed to coerce issuer to string")
+	}
+
+	iss, ok := v.issuers[issuerStr]
+	if !ok {
+		return nil, &UnknownIssuerError{Issuer: issuerStr}
+	}
+
+	return iss.keyFor(token)
+}
+
+// Parse parses and verifies a token, then validates its registered claims
+func (v *Verifier) Parse(tokenString string) (*jwt.Token, error) {
+	// exp, nbf and iat are checked by validateClaims instead, allowing for clock skew
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(tokenString, v.Keyfunc)
+	if err != nil {
+		return token, err
+	}
+
+	if err := v.validateClaims(token.Claims.(jwt.MapClaims), time.Now()); err != nil {
+		token.Valid = false
+		return token, err
+	}
+	return token, nil
+}
@@ -0,0 +1,305 @@
+// Package fetcher downloads remote files on behalf of clients. It only connects to the
+// addresses a host name resolves to after checking them against blocked networks, so
+// that neither DNS nor redirects can lead it to internal services.
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrInvalidURL occurs when a URL cannot be parsed or has no host
+var ErrInvalidURL = errors.New("The URL is invalid")
+
+// ErrUnsupportedScheme occurs when a URL is not http or https
+var ErrUnsupportedScheme = errors.New("Only http and https URLs can be fetched")
+
+// ErrBlockedAddress occurs when a URL, or one it redirects to, resolves to a blocked network
+var ErrBlockedAddress = errors.New("The URL points to an address that cannot be fetched")
+
+// ErrTooManyRedirects occurs when a URL redirects more often than allowed
+var ErrTooManyRedirects = errors.New("The URL redirects too many times")
+
+// ErrTooLarge occurs when the remote file exceeds the maximum size
+var ErrTooLarge = errors.New("The remote file exceeds the maximum upload size")
+
+// ErrTimeout occurs when the remote file is not downloaded within the timeout
+var ErrTimeout = errors.New("The remote server did not respond in time")
+
+// ErrTypeNotAllowed occurs when the remote file has a content type that is not accepted
+var ErrTypeNotAllowed = errors.New("The remote file has a type that is not accepted")
+
+// StatusError occurs when the remote server responds with an unsuccessful status
+type StatusError struct {
+	Status int
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("The remote server responded with %d %s", e.Status, http.StatusText(e.Status))
+}
+
+// SpecialPurposeRanges are the loopback, private, link-local, multicast and other
+// networks that are not publicly routable
+var SpecialPurposeRanges = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"100::/64",
+	"2001:db8::/32",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+// Config limits what a Fetcher downloads
+type Config struct {
+	Timeout      time.Duration // for the whole download, including redirects
+	MaxRedirects int
+	MaxSize      int64        // zero for unlimited
+	AllowedTypes []string     // content type prefixes, all types are accepted when empty
+	Blocked      []*net.IPNet // networks that are never connected to
+}
+
+// Fetcher downloads remote files
+type Fetcher struct {
+	cfg    Config
+	client *http.Client
+}
+
+// Response is a remote file being downloaded
+type Response struct {
+	Body        io.ReadCloser
+	Size        int64 // -1 when unknown
+	ContentType string
+	Filename    string
+}
+
+// New creates a Fetcher
+func New(cfg Config) *Fetcher {
+	f := &Fetcher{cfg: cfg}
+
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: f.checkDial,
+	}
+	f.client = &http.Client{
+		Transport: &http.Transport{
+			// a proxy would connect on our behalf, without the address being checked
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     30 * time.Second,
+		},
+		CheckRedirect: f.checkRedirect,
+	}
+	return f
+}
+
+// IsBlocked reports whether the IP is in one of the blocked networks
+func (f *Fetcher) IsBlocked(ip net.IP) bool {
+	for _, network := range f.cfg.Blocked {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDial runs after name resolution, right before connecting to an address
+func (f *Fetcher) checkDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || f.IsBlocked(ip) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
+
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.cfg.MaxRedirects {
+		return ErrTooManyRedirects
+	}
+	return checkURL(req.URL)
+}
+
+func checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrUnsupportedScheme
+	}
+	if u.Hostname() == "" {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
+// Fetch requests the URL and checks the size and type of the response. The caller must
+// close the body, which fails with ErrTooLarge once more than MaxSize bytes are read.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, ErrInvalidURL
+	}
+	if err := checkURL(u); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.cfg.Timeout)
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, cause(err)
+	}
+
+	fail := func(err error) (*Response, error) {
+		resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fail(StatusError{Status: resp.StatusCode})
+	}
+	if f.cfg.MaxSize > 0 && resp.ContentLength > f.cfg.MaxSize {
+		return fail(ErrTooLarge)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !f.typeAllowed(contentType) {
+		return fail(ErrTypeNotAllowed)
+	}
+
+	return &Response{
+		Body: &limitedBody{
+			body:      resp.Body,
+			remaining: f.cfg.MaxSize,
+			limited:   f.cfg.MaxSize > 0,
+			cancel:    cancel,
+		},
+		Size:        resp.ContentLength,
+		ContentType: contentType,
+		Filename:    filename(resp),
+	}, nil
+}
+
+func (f *Fetcher) typeAllowed(contentType string) bool {
+	if len(f.cfg.AllowedTypes) == 0 {
+		return true
+	}
+	for _, prefix := range f.cfg.AllowedTypes {
+		if contentType != "" && strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filename is taken from the Content-Disposition header, or else the final URL
+func filename(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		if name := path.Base(params["filename"]); params["filename"] != "" && name != "/" {
+			return name
+		}
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return resp.Request.URL.Hostname()
+}
+
+// cause unwraps the errors of the http client, keeping those returned by the checks
+func cause(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		if urlErr.Timeout() {
+			return ErrTimeout
+		}
+		err = urlErr.Err
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	switch err {
+	case ErrBlockedAddress, ErrTooManyRedirects, ErrUnsupportedScheme, ErrInvalidURL:
+		return err
+	case context.DeadlineExceeded:
+		return ErrTimeout
+	}
+	return fmt.Errorf("Failed to fetch the URL: %v", err)
+}
+
+// limitedBody fails once more than the remaining bytes are read, and releases the
+// request context when closed
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	limited   bool
+	cancel    context.CancelFunc
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.limited && int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.body.Read(p)
+	if netErr, ok := err.(net.Error); err == context.DeadlineExceeded || ok && netErr.Timeout() {
+		err = ErrTimeout
+	}
+	if b.limited {
+		b.remaining -= int64(n)
+		if b.remaining < 0 {
+			return n, ErrTooLarge
+		}
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	defer b.cancel()
+	return b.body.Close()
+}
@@ -0,0 +1,199 @@
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestFetcher(cfg Config) *Fetcher {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	return New(cfg)
+}
+
+func fetchAll(f *Fetcher, rawURL string) ([]byte, error) {
+	resp, err := f.Fetch(context.Background(), rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func hello(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, "hello")
+}
+
+func TestFetch(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(hello))
+	defer origin.Close()
+
+	resp, err := newTestFetcher(Config{}).Fetch(context.Background(), origin.URL+"/dir/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" || resp.ContentType != "text/plain" || resp.Filename != "hello.txt" {
+		t.Errorf("got %q of type %q named %q", body, resp.ContentType, resp.Filename)
+	}
+}
+
+func TestBlockedLoopback(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(hello))
+	defer origin.Close()
+
+	f := newTestFetcher(Config{Blocked: SpecialPurposeRanges})
+	if _, err := fetchAll(f, origin.URL); err != ErrBlockedAddress {
+		t.Errorf("expected ErrBlockedAddress, got %v", err)
+	}
+	if !f.IsBlocked(net.ParseIP("::1")) || f.IsBlocked(net.ParseIP("198.41.0.4")) {
+		t.Error("IsBlocked does not match SpecialPurposeRanges")
+	}
+}
+
+func TestRedirectToBlockedHost(t *testing.T) {
+	// another loopback address stands in for an internal service
+	listener, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %v", err)
+	}
+	internal := httptest.NewUnstartedServer(http.HandlerFunc(hello))
+	internal.Listener.Close()
+	internal.Listener = listener
+	internal.Start()
+	defer internal.Close()
+
+	origin := httptest.NewServer(http.RedirectHandler(internal.URL, http.StatusFound))
+	defer origin.Close()
+
+	f := newTestFetcher(Config{MaxRedirects: 5, Blocked: mustParseCIDRs("127.0.0.2/32")})
+	if _, err := fetchAll(f, origin.URL); err != ErrBlockedAddress {
+		t.Errorf("expected ErrBlockedAddress, got %v", err)
+	}
+}
+
+func TestUnsupportedScheme(t *testing.T) {
+	f := newTestFetcher(Config{MaxRedirects: 5})
+	if _, err := fetchAll(f, "ftp://example.org/file"); err != ErrUnsupportedScheme {
+		t.Errorf("expected ErrUnsupportedScheme, got %v", err)
+	}
+
+	origin := httptest.NewServer(http.RedirectHandler("ftp://example.org/file", http.StatusFound))
+	defer origin.Close()
+	if _, err := fetchAll(f, origin.URL); err != ErrUnsupportedScheme {
+		t.Errorf("expected ErrUnsupportedScheme after a redirect, got %v", err)
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	// /n redirects n times before serving the file
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if n > 0 {
+			http.Redirect(w, r, "/"+strconv.Itoa(n-1), http.StatusFound)
+			return
+		}
+		hello(w, r)
+	}))
+	defer origin.Close()
+
+	f := newTestFetcher(Config{MaxRedirects: 2})
+	if _, err := fetchAll(f, origin.URL+"/2"); err != nil {
+		t.Errorf("expected 2 redirects to be followed, got %v", err)
+	}
+	if _, err := fetchAll(f, origin.URL+"/3"); err != ErrTooManyRedirects {
+		t.Errorf("expected ErrTooManyRedirects, got %v", err)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := strings.Repeat("x", 100)
+		if r.URL.Path == "/streamed" {
+			// flushing before writing everything omits the Content-Length
+			w.Write([]byte(data[:10]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(data[10:]))
+			return
+		}
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte(data))
+	}))
+	defer origin.Close()
+
+	f := newTestFetcher(Config{MaxSize: 50})
+	if _, err := f.Fetch(context.Background(), origin.URL+"/sized"); err != ErrTooLarge {
+		t.Errorf("expected ErrTooLarge from Content-Length, got %v", err)
+	}
+
+	resp, err := f.Fetch(context.Background(), origin.URL+"/streamed")
+	if err != nil {
+		t.Fatalf("expected the streamed response to be accepted before reading, got %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Size != -1 {
+		t.Errorf("expected unknown size, got %d", resp.Size)
+	}
+	if _, err := ioutil.ReadAll(resp.Body); err != ErrTooLarge {
+		t.Errorf("expected ErrTooLarge while reading, got %v", err)
+	}
+
+	if body, err := fetchAll(newTestFetcher(Config{MaxSize: 100}), origin.URL+"/streamed"); err != nil || len(body) != 100 {
+		t.Errorf("expected a body of exactly MaxSize to be read, got %d bytes and %v", len(body), err)
+	}
+}
+
+func TestAllowedTypes(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", strings.TrimPrefix(r.URL.Path, "/"))
+		w.Write([]byte("data"))
+	}))
+	defer origin.Close()
+
+	f := newTestFetcher(Config{AllowedTypes: []string{"image/"}})
+	if _, err := fetchAll(f, origin.URL+"/image/png"); err != nil {
+		t.Errorf("expected image/png to be allowed, got %v", err)
+	}
+	if _, err := fetchAll(f, origin.URL+"/text/html"); err != ErrTypeNotAllowed {
+		t.Errorf("expected ErrTypeNotAllowed, got %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body" {
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer origin.Close()
+
+	f := newTestFetcher(Config{Timeout: 200 * time.Millisecond})
+	for _, p := range []string{"/slow-headers", "/slow-body"} {
+		start := time.Now()
+		if _, err := fetchAll(f, origin.URL+p); err != ErrTimeout {
+			t.Errorf("%s: expected ErrTimeout, got %v", p, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: timed out after %v", p, elapsed)
+		}
+	}
+}
@@ -12,6 +12,7 @@ import { showDashboardOnDragEnter } from './handlers/show-dashboard-on-drag-ente
 import { uploadOnPaste } from './handlers/upload-on-paste'
 import { closeModalWhenUploadsCompleted } from './handlers/uppy/close-modal-when-uploads-completed';
 import { shareCompletedUploadUrl } from './handlers/uppy/share-completed-upload-url';
+import { showServerRejection } from './handlers/uppy/show-server-rejection';
 import { trackFileUploadTarget } from './handlers/uppy/track-file-upload-target';
 import instantiateUppy from './instantiate-uppy'
 import { createPromptUpload } from './prompt-upload'
@@ -59,6 +60,9 @@ kiwi.plugin('fileuploader', function (kiwiApi, log) {
     // send message with link to buffer when upload finishes
     uppy.on('upload-success', shareCompletedUploadUrl(kiwiApi))
 
+    // explain why the server refused an upload
+    uppy.on('upload-error', showServerRejection(uppy))
+
     // hide dashboard after last upload finishes
     uppy.on('complete', closeModalWhenUploadsCompleted(uppy, dashboard))
 })
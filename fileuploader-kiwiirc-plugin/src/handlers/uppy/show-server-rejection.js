@@ -0,0 +1,16 @@
+export function showServerRejection(uppy) {
+    return function handleUploadError(file, error) {
+        // tus-js-client keeps the failed request, the server explains rejections
+        // (EXTJWT required, quota exceeded, ...) in the plain text response body
+        const xhr = error && error.originalRequest
+        const message = xhr && xhr.status >= 400 && xhr.responseText
+        if (!message) {
+            return
+        }
+
+        uppy.info({
+            message: `Upload of ${file.name} was refused`,
+            details: message,
+        }, 'error', 10000)
+    }
+}
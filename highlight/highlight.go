@@ -0,0 +1,230 @@
+// Package highlight renders source code as HTML with keywords, strings, comments and
+// numbers marked by classes. It is a simple lexer shared by many C-like and scripting
+// languages rather than a full parser, which is enough for reading pastes.
+package highlight
+
+import (
+	"html"
+	"html/template"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Classes of the spans in highlighted output
+const (
+	ClassKeyword = "k"
+	ClassString  = "s"
+	ClassComment = "c"
+	ClassNumber  = "n"
+)
+
+// Language describes the tokens of a language
+type Language struct {
+	Name            string
+	Aliases         []string
+	Extension       string
+	Keywords        []string
+	LineComments    []string
+	BlockComments   [][2]string
+	Quotes          []string // string delimiters, which may span lines when listed in MultilineQuotes
+	MultilineQuotes []string
+	CaseInsensitive bool
+
+	keywords map[string]bool
+}
+
+var languages = map[string]*Language{}
+
+// Lookup returns the language with the name or alias, ignoring case, or nil
+func Lookup(name string) *Language {
+	return languages[strings.ToLower(name)]
+}
+
+// Names returns the names of the supported languages, sorted
+func Names() []string {
+	var names []string
+	for key, lang := range languages {
+		if key == lang.Name {
+			names = append(names, lang.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func register(lang *Language) {
+	lang.keywords = make(map[string]bool, len(lang.Keywords))
+	for _, keyword := range lang.Keywords {
+		if lang.CaseInsensitive {
+			keyword = strings.ToLower(keyword)
+		}
+		lang.keywords[keyword] = true
+	}
+	languages[lang.Name] = lang
+	for _, alias := range lang.Aliases {
+		languages[alias] = lang
+	}
+}
+
+type token struct {
+	class string
+	text  string
+}
+
+// Lines renders each line of the source as HTML. A nil language escapes the lines
+// without highlighting.
+func (lang *Language) Lines(src string) []template.HTML {
+	var tokens []token
+	if lang == nil {
+		tokens = []token{{text: src}}
+	} else {
+		tokens = lang.tokenize(src)
+	}
+
+	lines := []template.HTML{}
+	var line strings.Builder
+	for _, tok := range tokens {
+		parts := strings.Split(tok.text, "\n")
+		for i, part := range parts {
+			if i > 0 {
+				lines = append(lines, template.HTML(line.String()))
+				line.Reset()
+			}
+			part = strings.TrimSuffix(part, "\r")
+			if part == "" {
+				continue
+			}
+			if tok.class == "" {
+				line.WriteString(html.EscapeString(part))
+			} else {
+				line.WriteString(`<span class="` + tok.class + `">` + html.EscapeString(part) + `</span>`)
+			}
+		}
+	}
+	if line.Len() > 0 || len(lines) == 0 {
+		lines = append(lines, template.HTML(line.String()))
+	}
+	return lines
+}
+
+func (lang *Language) tokenize(src string) []token {
+	var tokens []token
+	plainStart := 0
+	emit := func(start, end int, class string) {
+		if plainStart < start {
+			tokens = append(tokens, token{text: src[plainStart:start]})
+		}
+		tokens = append(tokens, token{class: class, text: src[start:end]})
+		plainStart = end
+	}
+
+	for i := 0; i < len(src); {
+		rest := src[i:]
+
+		if end, ok := lang.matchComment(rest); ok {
+			emit(i, i+end, ClassComment)
+			i += end
+			continue
+		}
+		if end, ok := lang.matchString(rest); ok {
+			emit(i, i+end, ClassString)
+			i += end
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(rest)
+		if unicode.IsDigit(r) {
+			end := i + scanWhile(rest, func(r rune) bool { return isIdent(r) || r == '.' })
+			emit(i, end, ClassNumber)
+			i = end
+			continue
+		}
+		if isIdent(r) {
+			end := i + scanWhile(rest, isIdent)
+			word := src[i:end]
+			if lang.CaseInsensitive {
+				word = strings.ToLower(word)
+			}
+			if lang.keywords[word] {
+				emit(i, end, ClassKeyword)
+			}
+			i = end
+			continue
+		}
+		i += size
+	}
+	if plainStart < len(src) {
+		tokens = append(tokens, token{text: src[plainStart:]})
+	}
+	return tokens
+}
+
+// matchComment returns the length of the comment at the start of the text
+func (lang *Language) matchComment(text string) (int, bool) {
+	for _, delims := range lang.BlockComments {
+		if strings.HasPrefix(text, delims[0]) {
+			end := strings.Index(text[len(delims[0]):], delims[1])
+			if end < 0 {
+				return len(text), true
+			}
+			return len(delims[0]) + end + len(delims[1]), true
+		}
+	}
+	for _, prefix := range lang.LineComments {
+		if strings.HasPrefix(text, prefix) {
+			if end := strings.IndexByte(text, '\n'); end >= 0 {
+				return end, true
+			}
+			return len(text), true
+		}
+	}
+	return 0, false
+}
+
+// matchString returns the length of the string literal at the start of the text.
+// Backslashes escape the next character, and strings that may not span lines end at
+// the end of the line when unterminated.
+func (lang *Language) matchString(text string) (int, bool) {
+	for _, quote := range lang.MultilineQuotes {
+		if strings.HasPrefix(text, quote) {
+			return scanString(text, quote, true), true
+		}
+	}
+	for _, quote := range lang.Quotes {
+		if strings.HasPrefix(text, quote) {
+			return scanString(text, quote, false), true
+		}
+	}
+	return 0, false
+}
+
+func scanString(text, quote string, multiline bool) int {
+	for i := len(quote); i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && quote != "`":
+			// an escaped newline still ends a string that may not span lines
+			if multiline || i+1 >= len(text) || text[i+1] != '\n' {
+				i++
+			}
+		case text[i] == '\n' && !multiline:
+			return i
+		case strings.HasPrefix(text[i:], quote):
+			return i + len(quote)
+		}
+	}
+	return len(text)
+}
+
+// scanWhile returns the length of the prefix of the text made of runes matching f
+func scanWhile(text string, f func(rune) bool) int {
+	if end := strings.IndexFunc(text, func(r rune) bool { return !f(r) }); end >= 0 {
+		return end
+	}
+	return len(text)
+}
+
+func isIdent(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,168 @@
+package highlight
+
+import (
+	"html/template"
+	"reflect"
+	"testing"
+)
+
+func span(class, text string) string {
+	return `<span class="` + class + `">` + text + `</span>`
+}
+
+var lineCases = []struct {
+	name string
+	lang string
+	src  string
+	want []string
+}{
+	{
+		name: "keyword",
+		lang: "go",
+		src:  "func main() {}",
+		want: []string{span(ClassKeyword, "func") + " main() {}"},
+	},
+	{
+		name: "keywords are whole words",
+		lang: "go",
+		src:  "iffy := format2",
+		want: []string{"iffy := format2"},
+	},
+	{
+		name: "case insensitive keyword",
+		lang: "sql",
+		src:  "SELECT 1",
+		want: []string{span(ClassKeyword, "SELECT") + " " + span(ClassNumber, "1")},
+	},
+	{
+		name: "number",
+		lang: "go",
+		src:  "x = 0x1F + 2.5",
+		want: []string{"x = " + span(ClassNumber, "0x1F") + " + " + span(ClassNumber, "2.5")},
+	},
+	{
+		name: "string",
+		lang: "go",
+		src:  `s := "if" + 'x'`,
+		want: []string{"s := " + span(ClassString, "&#34;if&#34;") + " + " + span(ClassString, "&#39;x&#39;")},
+	},
+	{
+		name: "escaped quote",
+		lang: "go",
+		src:  `"a\"b" c`,
+		want: []string{span(ClassString, `&#34;a\&#34;b&#34;`) + " c"},
+	},
+	{
+		name: "unterminated string ends with the line",
+		lang: "go",
+		src:  "s := \"abc\nfunc",
+		want: []string{"s := " + span(ClassString, "&#34;abc"), span(ClassKeyword, "func")},
+	},
+	{
+		name: "escaped newline ends the string",
+		lang: "go",
+		src:  "s := \"abc\\\nfunc",
+		want: []string{"s := " + span(ClassString, `&#34;abc\`), span(ClassKeyword, "func")},
+	},
+	{
+		name: "unterminated string at the end",
+		lang: "go",
+		src:  `"abc\`,
+		want: []string{span(ClassString, `&#34;abc\`)},
+	},
+	{
+		name: "multiline string",
+		lang: "go",
+		src:  "`a\\\nb` if",
+		want: []string{span(ClassString, "`a\\"), span(ClassString, "b`") + " " + span(ClassKeyword, "if")},
+	},
+	{
+		name: "unterminated multiline string",
+		lang: "python",
+		src:  "x = '''a\nif",
+		want: []string{"x = " + span(ClassString, "&#39;&#39;&#39;a"), span(ClassString, "if")},
+	},
+	{
+		name: "line comment",
+		lang: "go",
+		src:  "x // if \"y\"\nif",
+		want: []string{"x " + span(ClassComment, "// if &#34;y&#34;"), span(ClassKeyword, "if")},
+	},
+	{
+		name: "block comment",
+		lang: "go",
+		src:  "/* a\nb */ if",
+		want: []string{span(ClassComment, "/* a"), span(ClassComment, "b */") + " " + span(ClassKeyword, "if")},
+	},
+	{
+		name: "unterminated block comment",
+		lang: "go",
+		src:  "x /* a\nif",
+		want: []string{"x " + span(ClassComment, "/* a"), span(ClassComment, "if")},
+	},
+	{
+		name: "CRLF",
+		lang: "go",
+		src:  "if\r\n// c\r\n\"s\r\n\"t\\\r\nx\r\n",
+		want: []string{
+			span(ClassKeyword, "if"),
+			span(ClassComment, "// c"),
+			span(ClassString, "&#34;s"),
+			span(ClassString, `&#34;t\`),
+			"x",
+		},
+	},
+	{
+		name: "empty lines",
+		lang: "go",
+		src:  "if\n\nif",
+		want: []string{span(ClassKeyword, "if"), "", span(ClassKeyword, "if")},
+	},
+	{
+		name: "HTML escaping",
+		lang: "go",
+		src:  `a < b && c > d // <script>`,
+		want: []string{"a &lt; b &amp;&amp; c &gt; d " + span(ClassComment, "// &lt;script&gt;")},
+	},
+	{
+		name: "no language",
+		src:  "<b>if</b>\n\"x",
+		want: []string{"&lt;b&gt;if&lt;/b&gt;", "&#34;x"},
+	},
+	{
+		name: "empty",
+		lang: "go",
+		src:  "",
+		want: []string{""},
+	},
+}
+
+func TestLines(t *testing.T) {
+	for _, tc := range lineCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var lang *Language
+			if tc.lang != "" {
+				if lang = Lookup(tc.lang); lang == nil {
+					t.Fatalf("unknown language %q", tc.lang)
+				}
+			}
+
+			want := make([]template.HTML, len(tc.want))
+			for i, line := range tc.want {
+				want[i] = template.HTML(line)
+			}
+			if got := lang.Lines(tc.src); !reflect.DeepEqual(got, want) {
+				t.Errorf("got  %q\nwant %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if lang := Lookup("Golang"); lang == nil || lang.Name != "go" {
+		t.Errorf("expected the golang alias to find go, got %v", lang)
+	}
+	if lang := Lookup("brainfuck"); lang != nil {
+		t.Errorf("expected no language, got %v", lang.Name)
+	}
+}
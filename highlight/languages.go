@@ -0,0 +1,236 @@
+package highlight
+
+var cComments = [][2]string{{"/*", "*/"}}
+
+func init() {
+	register(&Language{
+		Name:          "c",
+		Aliases:       []string{"h"},
+		Extension:     ".c",
+		LineComments:  []string{"//"},
+		BlockComments: cComments,
+		Quotes:        []string{`"`, "'"},
+		Keywords: []string{
+			"auto", "break", "case", "char", "const", "continue", "default", "do", "double",
+			"else", "enum", "extern", "float", "for", "goto", "if", "inline", "int", "long",
+			"register", "restrict", "return", "short", "signed", "sizeof", "static", "struct",
+			"switch", "typedef", "union", "unsigned", "void", "volatile", "while", "NULL",
+			"bool", "true", "false",
+		},
+	})
+	register(&Language{
+		Name:          "cpp",
+		Aliases:       []string{"c++", "cc", "cxx", "hpp"},
+		Extension:     ".cpp",
+		LineComments:  []string{"//"},
+		BlockComments: cComments,
+		Quotes:        []string{`"`, "'"},
+		Keywords: []string{
+			"auto", "bool", "break", "case", "catch", "char", "class", "const", "constexpr",
+			"continue", "default", "delete", "do", "double", "else", "enum", "explicit",
+			"extern", "false", "float", "for", "friend", "goto", "if", "inline", "int", "long",
+			"namespace", "new", "noexcept", "nullptr", "operator", "override", "private",
+			"protected", "public", "return", "short", "signed", "sizeof", "static", "struct",
+			"switch", "template", "this", "throw", "true", "try", "typedef", "typename",
+			"union", "unsigned", "using", "virtual", "void", "volatile", "while",
+		},
+	})
+	register(&Language{
+		Name:          "csharp",
+		Aliases:       []string{"c#", "cs"},
+		Extension:     ".cs",
+		LineComments:  []string{"//"},
+		BlockComments: cComments,
+		Quotes:        []string{`"`, "'"},
+		Keywords: []string{
+			"abstract", "as", "async", "await", "base", "bool", "break", "case", "catch",
+			"class", "const", "continue", "default", "delegate", "do", "else", "enum", "event",
+			"false", "finally", "for", "foreach", "if", "in", "int", "interface", "internal",
+			"is", "namespace", "new", "null", "out", "override", "private", "protected",
+			"public", "readonly", "ref", "return", "sealed", "static", "string", "struct",
+			"switch", "this", "throw", "true", "try", "using", "var", "virtual", "void", "while",
+		},
+	})
+	register(&Language{
+		Name:            "go",
+		Aliases:         []string{"golang"},
+		Extension:       ".go",
+		LineComments:    []string{"//"},
+		BlockComments:   cComments,
+		Quotes:          []string{`"`, "'"},
+		MultilineQuotes: []string{"`"},
+		Keywords: []string{
+			"break", "case", "chan", "const", "continue", "default", "defer", "else",
+			"fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map",
+			"package", "range", "return", "select", "struct", "switch", "type", "var",
+			"nil", "true", "false", "iota",
+		},
+	})
+	register(&Language{
+		Name:          "java",
+		Extension:     ".java",
+		LineComments:  []string{"//"},
+		BlockComments: cComments,
+		Quotes:        []string{`"`, "'"},
+		Keywords: []string{
+			"abstract", "boolean", "break", "byte", "case", "catch", "char", "class",
+			"continue", "default", "do", "double", "else", "enum", "extends", "false", "final",
+			"finally", "float", "for", "if", "implements", "import", "instanceof", "int",
+			"interface", "long", "new", "null", "package", "private", "protected", "public",
+			"return", "short", "static", "super", "switch", "synchronized", "this", "throw",
+			"throws", "true", "try", "var", "void", "volatile", "while",
+		},
+	})
+	register(&Language{
+		Name:            "javascript",
+		Aliases:         []string{"js", "jsx", "node"},
+		Extension:       ".js",
+		LineComments:    []string{"//"},
+		BlockComments:   cComments,
+		Quotes:          []string{`"`, "'"},
+		MultilineQuotes: []string{"`"},
+		Keywords:        javascriptKeywords,
+	})
+	register(&Language{
+		Name:            "typescript",
+		Aliases:         []string{"ts", "tsx"},
+		Extension:       ".ts",
+		LineComments:    []string{"//"},
+		BlockComments:   cComments,
+		Quotes:          []string{`"`, "'"},
+		MultilineQuotes: []string{"`"},
+		Keywords: append([]string{
+			"abstract", "any", "boolean", "declare", "enum", "implements", "interface",
+			"keyof", "namespace", "never", "number", "private", "protected", "public",
+			"readonly", "string", "type", "unknown", "void",
+		}, javascriptKeywords...),
+	})
+	register(&Language{
+		Name:      "json",
+		Extension: ".json",
+		Quotes:    []string{`"`},
+		Keywords:  []string{"true", "false", "null"},
+	})
+	register(&Language{
+		Name:          "lua",
+		Extension:     ".lua",
+		LineComments:  []string{"--"},
+		BlockComments: [][2]string{{"--[[", "]]"}},
+		Quotes:        []string{`"`, "'"},
+		Keywords: []string{
+			"and", "break", "do", "else", "elseif", "end", "false", "for", "function", "goto",
+			"if", "in", "local", "nil", "not", "or", "repeat", "return", "then", "true",
+			"until", "while",
+		},
+	})
+	register(&Language{
+		Name:         "perl",
+		Aliases:      []string{"pl", "pm"},
+		Extension:    ".pl",
+		LineComments: []string{"#"},
+		Quotes:       []string{`"`, "'"},
+		Keywords: []string{
+			"and", "else", "elsif", "for", "foreach", "if", "last", "local", "my", "next",
+			"not", "or", "our", "package", "print", "return", "sub", "unless", "until", "use",
+			"while",
+		},
+	})
+	register(&Language{
+		Name:          "php",
+		Extension:     ".php",
+		LineComments:  []string{"//", "#"},
+		BlockComments: cComments,
+		Quotes:        []string{`"`, "'"},
+		Keywords: []string{
+			"abstract", "array", "as", "break", "case", "catch", "class", "const", "continue",
+			"default", "do", "echo", "else", "elseif", "extends", "false", "finally", "for",
+			"foreach", "function", "global", "if", "implements", "include", "interface", "new",
+			"null", "private", "protected", "public", "require", "return", "static", "switch",
+			"throw", "true", "try", "use", "while",
+		},
+	})
+	register(&Language{
+		Name:            "python",
+		Aliases:         []string{"py", "python3"},
+		Extension:       ".py",
+		LineComments:    []string{"#"},
+		Quotes:          []string{`"`, "'"},
+		MultilineQuotes: []string{`"""`, "'''"},
+		Keywords: []string{
+			"and", "as", "assert", "async", "await", "break", "class", "continue", "def",
+			"del", "elif", "else", "except", "False", "finally", "for", "from", "global", "if",
+			"import", "in", "is", "lambda", "None", "nonlocal", "not", "or", "pass", "raise",
+			"return", "True", "try", "while", "with", "yield",
+		},
+	})
+	register(&Language{
+		Name:         "ruby",
+		Aliases:      []string{"rb"},
+		Extension:    ".rb",
+		LineComments: []string{"#"},
+		Quotes:       []string{`"`, "'"},
+		Keywords: []string{
+			"alias", "and", "begin", "break", "case", "class", "def", "do", "else", "elsif",
+			"end", "ensure", "false", "for", "if", "in", "module", "next", "nil", "not", "or",
+			"redo", "rescue", "retry", "return", "self", "super", "then", "true", "unless",
+			"until", "when", "while", "yield",
+		},
+	})
+	register(&Language{
+		Name:          "rust",
+		Aliases:       []string{"rs"},
+		Extension:     ".rs",
+		LineComments:  []string{"//"},
+		BlockComments: cComments,
+		// single quotes also start lifetimes, so only double quoted strings are marked
+		Quotes: []string{`"`},
+		Keywords: []string{
+			"as", "async", "await", "break", "const", "continue", "crate", "dyn", "else",
+			"enum", "extern", "false", "fn", "for", "if", "impl", "in", "let", "loop", "match",
+			"mod", "move", "mut", "pub", "ref", "return", "self", "Self", "static", "struct",
+			"super", "trait", "true", "type", "unsafe", "use", "where", "while",
+		},
+	})
+	register(&Language{
+		Name:         "shell",
+		Aliases:      []string{"sh", "bash", "zsh"},
+		Extension:    ".sh",
+		LineComments: []string{"#"},
+		Quotes:       []string{`"`, "'"},
+		Keywords: []string{
+			"case", "do", "done", "elif", "else", "esac", "exit", "export", "fi", "for",
+			"function", "if", "in", "local", "return", "then", "until", "while",
+		},
+	})
+	register(&Language{
+		Name:            "sql",
+		Extension:       ".sql",
+		LineComments:    []string{"--"},
+		BlockComments:   cComments,
+		Quotes:          []string{"'"},
+		CaseInsensitive: true,
+		Keywords: []string{
+			"add", "all", "alter", "and", "as", "asc", "between", "by", "case", "create",
+			"delete", "desc", "distinct", "drop", "else", "end", "exists", "from", "group",
+			"having", "in", "index", "inner", "insert", "into", "is", "join", "key", "left",
+			"like", "limit", "not", "null", "on", "or", "order", "outer", "primary", "right",
+			"select", "set", "table", "then", "union", "update", "values", "when", "where",
+		},
+	})
+	register(&Language{
+		Name:         "yaml",
+		Aliases:      []string{"yml"},
+		Extension:    ".yaml",
+		LineComments: []string{"#"},
+		Quotes:       []string{`"`, "'"},
+		Keywords:     []string{"true", "false", "null", "yes", "no"},
+	})
+}
+
+var javascriptKeywords = []string{
+	"async", "await", "break", "case", "catch", "class", "const", "continue", "default",
+	"delete", "do", "else", "export", "extends", "false", "finally", "for", "from",
+	"function", "if", "import", "in", "instanceof", "let", "new", "null", "of", "return",
+	"static", "super", "switch", "this", "throw", "true", "try", "typeof", "undefined",
+	"var", "void", "while", "yield",
+}
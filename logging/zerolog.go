@@ -1,7 +1,9 @@
 package logging
 
 import (
+	"bytes"
 	"io"
+	"strings"
 
 	"github.com/rs/zerolog"
 )
@@ -31,3 +33,29 @@ func MaxLevel(a, b zerolog.Level) zerolog.Level {
 	}
 	return b
 }
+
+// FuncLevelWriter passes each log event, formatted for humans, to a function along with
+// its level. Used to hand log events to a host application such as webircgateway.
+type FuncLevelWriter struct {
+	Func func(level zerolog.Level, line string)
+}
+
+func (flw FuncLevelWriter) Write(p []byte) (n int, err error) {
+	return flw.WriteLevel(zerolog.NoLevel, p)
+}
+
+// WriteLevel formats the payload and passes it to the function
+func (flw FuncLevelWriter) WriteLevel(l zerolog.Level, p []byte) (n int, err error) {
+	var buf bytes.Buffer
+	console := zerolog.ConsoleWriter{
+		Out:     &buf,
+		NoColor: true,
+		// the host adds its own timestamp
+		PartsOrder: []string{zerolog.LevelFieldName, zerolog.MessageFieldName},
+	}
+	if _, err := console.Write(p); err != nil {
+		return 0, err
+	}
+	flw.Func(l, strings.TrimRight(buf.String(), "\n"))
+	return len(p), nil
+}
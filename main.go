@@ -2,13 +2,63 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
 	"github.com/kiwiirc/plugin-fileuploader/server"
 )
 
 func main() {
 	var configPath = flag.String("config", "fileuploader.config.toml", "path to config file")
+	var overrides server.Overrides
+	flag.Var(&overrides, "set", "override a config value as section.key=value, repeatable")
+	flag.Usage = usage
 	flag.Parse()
-	runCtx := server.NewRunContext(nil, *configPath)
-	runCtx.Run()
+
+	if flag.NArg() == 0 {
+		runCtx := server.NewRunContext(nil, *configPath)
+		runCtx.SetOverrides(overrides)
+		if err := runCtx.Run(); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "expire":
+		err = expireCommand(*configPath, overrides, args)
+	case "hold":
+		err = holdCommand(*configPath, overrides, args)
+	case "ban":
+		err = banCommand(*configPath, overrides, args)
+	case "config":
+		err = configCommand(*configPath, overrides, args)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %#v\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Runs the upload server when no command is given.")
+	fmt.Fprintln(out, "\nCommands:")
+	fmt.Fprintln(out, "  expire [--dry-run] [--max-age d] [--identified-max-age d]")
+	fmt.Fprintln(out, "        run an expiration cycle immediately")
+	fmt.Fprintln(out, "  hold set --reason r [--actor a] <id> | hold clear <id> | hold list")
+	fmt.Fprintln(out, "        protect uploads from expiry and deletion")
+	fmt.Fprintln(out, "  ban add [--reason r] [--duration d] [--terminate] <ip|cidr> | ban remove <ip|cidr> | ban list")
+	fmt.Fprintln(out, "        refuse requests from addresses")
+	fmt.Fprintln(out, "  config check | config show")
+	fmt.Fprintln(out, "        validate the config, or print the effective config and where each value was set")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
 }
@@ -0,0 +1,45 @@
+// Package metrics publishes counters and gauges through expvar
+package metrics
+
+import (
+	"expvar"
+)
+
+var (
+	all = expvar.NewMap("fileuploader")
+
+	// ExpiryRuns counts started expiry runs
+	ExpiryRuns = newInt("expiry_runs")
+	// ExpiryRunning is 1 while an expiry run is in progress
+	ExpiryRunning = newInt("expiry_running")
+	// ExpiryProcessed counts uploads examined by the current or last expiry run
+	ExpiryProcessed = newInt("expiry_processed")
+	// ExpiryLastDuration is the duration of the last completed expiry run in seconds
+	ExpiryLastDuration = newFloat("expiry_last_duration_seconds")
+	// ExpiredUploads counts uploads terminated by expiry
+	ExpiredUploads = newInt("expired_uploads")
+	// ExpiredBytes counts bytes of uploads terminated by expiry
+	ExpiredBytes = newInt("expired_bytes")
+	// ExpiryFailures counts expired uploads that failed to terminate
+	ExpiryFailures = newInt("expiry_failures")
+	// EvictedUploads counts uploads terminated by disk-pressure eviction
+	EvictedUploads = newInt("evicted_uploads")
+)
+
+// JSON returns the current values as a JSON object. Unlike the expvar handler, it leaves
+// out the command line and memory statistics published by the runtime.
+func JSON() string {
+	return all.String()
+}
+
+func newInt(name string) *expvar.Int {
+	v := new(expvar.Int)
+	all.Set(name, v)
+	return v
+}
+
+func newFloat(name string) *expvar.Float {
+	v := new(expvar.Float)
+	all.Set(name, v)
+	return v
+}
@@ -0,0 +1,103 @@
+// Package policy selects upload limits based on the EXTJWT issuer, account and MIME
+// type of an upload.
+package policy
+
+import (
+	"path"
+	"time"
+)
+
+// Limits are the settings a Policy can override. Zero values defer to the defaults.
+type Limits struct {
+	MaxAge            time.Duration
+	IdentifiedMaxAge  time.Duration
+	MaximumUploadSize int64
+	Quota             int64 // bytes of live uploads per account, or per IP when anonymous
+}
+
+// MaxAgeFor returns the maximum age for identified or anonymous uploads
+func (l Limits) MaxAgeFor(identified bool) time.Duration {
+	if identified {
+		return l.IdentifiedMaxAge
+	}
+	return l.MaxAge
+}
+
+func (l Limits) withDefaults(defaults Limits) Limits {
+	if l.MaxAge == 0 {
+		l.MaxAge = defaults.MaxAge
+	}
+	if l.IdentifiedMaxAge == 0 {
+		l.IdentifiedMaxAge = defaults.IdentifiedMaxAge
+	}
+	if l.MaximumUploadSize == 0 {
+		l.MaximumUploadSize = defaults.MaximumUploadSize
+	}
+	if l.Quota == 0 {
+		l.Quota = defaults.Quota
+	}
+	return l
+}
+
+// Policy overrides limits for uploads matching all of its patterns.
+// Patterns use path.Match syntax, an empty pattern matches anything. The MIME type is
+// declared by the uploader, so Type patterns only select limits advisorily.
+type Policy struct {
+	Issuer  string
+	Account string
+	Type    string
+	Limits
+}
+
+func (p *Policy) matches(issuer, account, mimeType string) bool {
+	return matchPattern(p.Issuer, issuer) &&
+		matchPattern(p.Account, account) &&
+		matchPattern(p.Type, mimeType)
+}
+
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+// Table holds the global default limits and the policies overriding them
+type Table struct {
+	Defaults Limits
+	Policies []Policy
+}
+
+// Lookup returns the limits of the first policy matching the upload, falling back to the defaults
+func (t *Table) Lookup(issuer, account, mimeType string) Limits {
+	for i := range t.Policies {
+		if t.Policies[i].matches(issuer, account, mimeType) {
+			return t.Policies[i].Limits.withDefaults(t.Defaults)
+		}
+	}
+	return t.Defaults
+}
+
+// ShortestMaxAge returns the smallest maximum age any identified or anonymous upload can have
+func (t *Table) ShortestMaxAge(identified bool) time.Duration {
+	shortest := t.Defaults.MaxAgeFor(identified)
+	for _, p := range t.Policies {
+		age := p.Limits.withDefaults(t.Defaults).MaxAgeFor(identified)
+		if age < shortest {
+			shortest = age
+		}
+	}
+	return shortest
+}
+
+// LargestUploadSize returns the largest upload size permitted by any policy
+func (t *Table) LargestUploadSize() int64 {
+	largest := t.Defaults.MaximumUploadSize
+	for _, p := range t.Policies {
+		if p.MaximumUploadSize > largest {
+			largest = p.MaximumUploadSize
+		}
+	}
+	return largest
+}
@@ -0,0 +1,149 @@
+// Package ratelimit keeps a token bucket per client key. Buckets outlive config
+// reloads, their limits are updated in place.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// how often idle buckets are looked for
+const pruneInterval = time.Minute
+
+// Limits configures the buckets of a Group. The group is disabled when Rate is zero.
+type Limits struct {
+	Rate  rate.Limit // tokens added per second
+	Burst int        // bucket capacity
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// Group holds one token bucket per key, all sharing the same limits
+type Group struct {
+	mu        sync.Mutex
+	limits    Limits
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+// NewGroup creates a disabled Group
+func NewGroup() *Group {
+	return &Group{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// SetLimits changes the limits of the group, including those of existing buckets
+func (g *Group) SetLimits(limits Limits) {
+	if limits.Burst < 1 {
+		limits.Burst = 1
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.limits = limits
+	for _, b := range g.buckets {
+		b.limiter.SetLimit(limits.Rate)
+		b.limiter.SetBurst(limits.Burst)
+	}
+}
+
+// Enabled reports whether the group limits anything
+func (g *Group) Enabled() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.limits.Rate > 0
+}
+
+// Reserve takes a token from the bucket of the key. The returned reservation's delay is
+// non-zero if the token was not available yet, it should then be cancelled. Returns nil
+// when the group is disabled or the key is empty.
+func (g *Group) Reserve(key string) *rate.Reservation {
+	limiter := g.limiter(key)
+	if limiter == nil {
+		return nil
+	}
+	return limiter.Reserve()
+}
+
+// Debt returns how long until the bucket of the key has repaid its debt, without
+// taking a token
+func (g *Group) Debt(key string) time.Duration {
+	limiter := g.limiter(key)
+	if limiter == nil {
+		return 0
+	}
+	now := time.Now()
+	return limiter.ReserveN(now, 0).DelayFrom(now)
+}
+
+// Take removes n tokens from the bucket of the key, going into debt if they are not
+// available. Returns how long until the debt is repaid, which later reservations are
+// also delayed by.
+func (g *Group) Take(key string, n int) time.Duration {
+	limiter := g.limiter(key)
+	if limiter == nil {
+		return 0
+	}
+
+	// a single reservation cannot exceed the burst size
+	now := time.Now()
+	var delay time.Duration
+	for n > 0 {
+		chunk := n
+		if burst := limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		delay = limiter.ReserveN(now, chunk).DelayFrom(now)
+		n -= chunk
+	}
+	return delay
+}
+
+func (g *Group) limiter(key string) *rate.Limiter {
+	if key == "" {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.limits.Rate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Sub(g.lastPrune) > pruneInterval {
+		g.prune(now)
+	}
+
+	b, ok := g.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(g.limits.Rate, g.limits.Burst)}
+		g.buckets[key] = b
+	}
+	b.lastUsed = now
+	return b.limiter
+}
+
+// prune drops buckets that are full again, they are indistinguishable from new ones
+func (g *Group) prune(now time.Time) {
+	g.lastPrune = now
+	for key, b := range g.buckets {
+		if now.Sub(b.lastUsed) < pruneInterval {
+			continue
+		}
+		r := b.limiter.ReserveN(now, g.limits.Burst)
+		full := r.OK() && r.DelayFrom(now) == 0
+		r.CancelAt(now)
+		if full {
+			delete(g.buckets, key)
+		}
+	}
+}
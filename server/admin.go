@@ -0,0 +1,296 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/expirer"
+	"github.com/kiwiirc/plugin-fileuploader/metrics"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// ErrAdminUnauthorized occurs when an admin API request has a missing or unknown token
+var ErrAdminUnauthorized = errors.New("Missing or invalid admin token")
+
+func (serv *UploadServer) adminEnabled() bool {
+	return len(serv.cfg.Admin.Tokens) > 0
+}
+
+func (serv *UploadServer) registerAdminHandlers(r *gin.Engine) error {
+	if !serv.adminEnabled() {
+		return nil
+	}
+
+	routePrefix, err := routePrefixFromBasePath(serv.cfg.Admin.BasePath)
+	if err != nil {
+		return err
+	}
+
+	rg := r.Group(routePrefix, adminAuth(serv.cfg.Admin.Tokens))
+	rg.GET("metrics", adminMetrics)
+	rg.POST("expire", serv.adminExpire)
+	rg.GET("holds", serv.adminListHolds)
+	rg.PUT("uploads/:id/hold", serv.adminSetHold)
+	rg.DELETE("uploads/:id/hold", serv.adminClearHold)
+	rg.GET("bans", serv.adminListBans)
+	rg.POST("bans", serv.adminAddBan)
+	rg.DELETE("bans", serv.adminRemoveBan)
+	rg.GET("config", serv.adminShowConfig)
+
+	return nil
+}
+
+// adminAuth rejects requests that lack an "Authorization: Bearer <token>" header
+// matching one of the configured tokens
+func adminAuth(tokens []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasAdminToken(c.Request, tokens) {
+			adminError(c, http.StatusUnauthorized, ErrAdminUnauthorized)
+		}
+	}
+}
+
+func hasAdminToken(req *http.Request, tokens []string) bool {
+	const bearerPrefix = "Bearer "
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return false
+	}
+
+	given := []byte(strings.TrimPrefix(header, bearerPrefix))
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func adminError(c *gin.Context, status int, err error) {
+	c.Error(err).SetType(gin.ErrorTypePublic)
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
+
+// adminExpire runs a collection immediately.
+// Query parameters: dry_run (bool), max_age and identified_max_age (durations)
+func (serv *UploadServer) adminExpire(c *gin.Context) {
+	var opts expirer.RunOptions
+	var err error
+
+	if dryRun := c.Query("dry_run"); dryRun != "" {
+		opts.DryRun, err = strconv.ParseBool(dryRun)
+		if err != nil {
+			adminError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if maxAge := c.Query("max_age"); maxAge != "" {
+		opts.MaxAge, err = time.ParseDuration(maxAge)
+		if err != nil {
+			adminError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if identifiedMaxAge := c.Query("identified_max_age"); identifiedMaxAge != "" {
+		opts.IdentifiedMaxAge, err = time.ParseDuration(identifiedMaxAge)
+		if err != nil {
+			adminError(c, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	opts.ListUploads = true
+	report, err := serv.resources.currentExpirer().Run(opts)
+	if err == expirer.ErrRunInProgress {
+		adminError(c, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		adminError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+func (serv *UploadServer) adminListHolds(c *gin.Context) {
+	holds, err := serv.store.ListHolds()
+	if err != nil {
+		adminError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, holds)
+}
+
+// adminSetHold places an upload under hold.
+// JSON body: {"reason": "...", "actor": "..."}, the reason is required
+func (serv *UploadServer) adminSetHold(c *gin.Context) {
+	var body struct {
+		Reason string `json:"reason"`
+		Actor  string `json:"actor"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		adminError(c, http.StatusBadRequest, err)
+		return
+	}
+	if body.Reason == "" {
+		adminError(c, http.StatusBadRequest, errors.New("A reason is required"))
+		return
+	}
+	if body.Actor == "" {
+		body.Actor = "admin-api"
+	}
+
+	id := c.Param("id")
+	if err := serv.store.SetHold(id, body.Reason, body.Actor); err != nil {
+		adminError(c, http.StatusNotFound, err)
+		return
+	}
+
+	serv.log.Info().
+		Str("event", "hold_set").
+		Str("id", id).
+		Str("reason", body.Reason).
+		Str("actor", body.Actor).
+		Msg("Upload placed under hold")
+
+	c.Status(http.StatusNoContent)
+}
+
+func (serv *UploadServer) adminClearHold(c *gin.Context) {
+	id := c.Param("id")
+	if err := serv.store.ClearHold(id); err == shardedfilestore.ErrUploadNotFound {
+		adminError(c, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		adminError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	serv.log.Info().
+		Str("event", "hold_cleared").
+		Str("id", id).
+		Msg("Upload hold cleared")
+
+	c.Status(http.StatusNoContent)
+}
+
+func (serv *UploadServer) adminListBans(c *gin.Context) {
+	bans, err := serv.store.ListBans()
+	if err != nil {
+		adminError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, bans)
+}
+
+// adminAddBan bans an IP address or CIDR range.
+// JSON body: {"cidr": "...", "reason": "...", "actor": "...", "duration": "24h", "terminate": true}.
+// Bans without a duration are permanent. With terminate set, existing uploads from the
+// range are deleted.
+func (serv *UploadServer) adminAddBan(c *gin.Context) {
+	var body struct {
+		CIDR      string `json:"cidr"`
+		Reason    string `json:"reason"`
+		Actor     string `json:"actor"`
+		Duration  string `json:"duration"`
+		Terminate bool   `json:"terminate"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		adminError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	network, err := ParseBanRange(body.CIDR)
+	if err != nil {
+		adminError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var expiresAt time.Time
+	if body.Duration != "" {
+		duration, err := time.ParseDuration(body.Duration)
+		if err != nil {
+			adminError(c, http.StatusBadRequest, err)
+			return
+		}
+		expiresAt = time.Now().Add(duration)
+	}
+	if body.Actor == "" {
+		body.Actor = "admin-api"
+	}
+
+	if err := serv.store.AddBan(network, body.Reason, body.Actor, expiresAt); err != nil {
+		adminError(c, http.StatusInternalServerError, err)
+		return
+	}
+	serv.bans.invalidate()
+
+	serv.log.Info().
+		Str("event", "ban_added").
+		Str("cidr", network.String()).
+		Str("reason", body.Reason).
+		Str("actor", body.Actor).
+		Msg("Range banned")
+
+	terminated := []string{}
+	if body.Terminate {
+		terminated, err = serv.store.TerminateUploadsFrom(network)
+		if err != nil {
+			adminError(c, http.StatusInternalServerError, err)
+			return
+		}
+		serv.log.Info().
+			Str("event", "ban_terminated").
+			Str("cidr", network.String()).
+			Int("count", len(terminated)).
+			Msg("Terminated uploads from banned range")
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"cidr":       network.String(),
+		"terminated": terminated,
+	})
+}
+
+// adminRemoveBan lifts the ban given by the cidr query parameter
+func (serv *UploadServer) adminRemoveBan(c *gin.Context) {
+	network, err := ParseBanRange(c.Query("cidr"))
+	if err != nil {
+		adminError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := serv.store.RemoveBan(network); err != nil {
+		adminError(c, http.StatusNotFound, err)
+		return
+	}
+	serv.bans.invalidate()
+
+	serv.log.Info().
+		Str("event", "ban_removed").
+		Str("cidr", network.String()).
+		Msg("Range unbanned")
+
+	c.Status(http.StatusNoContent)
+}
+
+// adminMetrics serves the fileuploader metrics only, as the command line published by
+// expvar may contain secrets given with --set
+func adminMetrics(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", []byte(metrics.JSON()))
+}
+
+// adminShowConfig lists the config the server is running with, annotating each value
+// with its source. Secrets are redacted.
+func (serv *UploadServer) adminShowConfig(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"settings": serv.cfg.Settings()})
+}
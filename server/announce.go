@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/kiwiirc/plugin-fileuploader/events"
+	"github.com/kiwiirc/plugin-fileuploader/extjwt"
+	"github.com/tus/tusd/cmd/tusd/cli/hooks"
+)
+
+// ErrAnnounceTokenMissing occurs when an announcement is requested without a channel EXTJWT
+var ErrAnnounceTokenMissing = errors.New("Announcing an upload requires an EXTJWT for the channel")
+
+// ErrAnnounceNotJoined occurs when the token of an upload to be announced is for another
+// channel, or shows the uploader has not joined it
+var ErrAnnounceNotJoined = errors.New("The EXTJWT presented does not show membership of the channel to announce to")
+
+// Announcement is a message to be sent to a channel by the connection of the uploader
+type Announcement struct {
+	Issuer  string // identifies the network
+	Nick    string
+	Channel string
+	Line    string // raw IRC line, without the trailing CRLF
+}
+
+// Announcer sends announcements through the IRC connection of the uploader, such as one
+// held by a webircgateway
+type Announcer func(announcement Announcement) error
+
+// announcementsEnabled reports whether finished uploads can be announced
+func (serv *UploadServer) announcementsEnabled() bool {
+	return serv.cfg.Announce.Enabled && serv.announcer != nil
+}
+
+// checkAnnouncement validates the "announce" metadata field of a creation request against
+// the claims of its EXTJWT, or nil claims when none was given
+func (serv *UploadServer) checkAnnouncement(metadata map[string]string, claims jwt.MapClaims) error {
+	target, ok := metadata["announce"]
+	if !ok || !serv.announcementsEnabled() {
+		return nil
+	}
+	if claims == nil {
+		return ErrAnnounceTokenMissing
+	}
+
+	channel, _ := claims["channel"].(string)
+	joined, _, err := extjwt.Joined(claims)
+	if err != nil || !joined || !strings.EqualFold(target, channel) {
+		return ErrAnnounceNotJoined
+	}
+	return nil
+}
+
+// announceBaseURL returns the absolute URL of BasePath used in download links
+func (cfg *Config) announceBaseURL() (*url.URL, error) {
+	base := cfg.Announce.BaseURL
+	if base == "" {
+		base = cfg.Server.BasePath
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return nil, errors.New("an absolute URL is required when BasePath is a path")
+	}
+	return u, nil
+}
+
+// announceFinished announces finished uploads that requested it, after processJwt
+// verified the uploader was in the channel
+func (serv *UploadServer) announceFinished(broadcaster *events.TusEventBroadcaster) {
+	channel := broadcaster.Listen()
+	for {
+		event, ok := <-channel
+		if !ok {
+			return // channel closed
+		}
+		if event.Type != hooks.HookPostFinish || !serv.announcementsEnabled() {
+			continue
+		}
+
+		meta := event.Info.MetaData
+		target := meta["announce"]
+		if target == "" || meta["issuer"] == "" || meta["nick"] == "" || !strings.EqualFold(target, meta["channel"]) {
+			continue
+		}
+
+		announcement, err := serv.newAnnouncement(event.Info.ID, event.Info.Size, meta)
+		if err == nil {
+			err = serv.announcer(announcement)
+		}
+		if err != nil {
+			serv.log.Warn().
+				Err(err).
+				Str("event", "announce_failed").
+				Str("id", event.Info.ID).
+				Str("channel", announcement.Channel).
+				Msg("Failed to announce upload")
+			continue
+		}
+
+		serv.log.Info().
+			Str("event", "announced").
+			Str("id", event.Info.ID).
+			Str("issuer", announcement.Issuer).
+			Str("nick", announcement.Nick).
+			Str("channel", announcement.Channel).
+			Msg("Announced upload")
+	}
+}
+
+func (serv *UploadServer) newAnnouncement(id string, size int64, meta map[string]string) (Announcement, error) {
+	announcement := Announcement{
+		Issuer:  meta["issuer"],
+		Nick:    meta["nick"],
+		Channel: meta["channel"],
+	}
+
+	base, err := serv.cfg.announceBaseURL()
+	if err != nil {
+		return announcement, err
+	}
+
+	filename := meta["filename"]
+	if filename == "" {
+		filename = meta["name"]
+	}
+
+	link := strings.TrimSuffix(base.String(), "/") + "/" + url.PathEscape(id)
+	if filename != "" {
+		link += "/" + url.PathEscape(filename)
+	}
+
+	text := strings.NewReplacer(
+		"{nick}", announcement.Nick,
+		"{filename}", filename,
+		"{size}", datasize.ByteSize(size).HumanReadable(),
+		"{url}", link,
+	).Replace(serv.cfg.Announce.Message)
+
+	line := fmt.Sprintf("%s %s :%s", strings.ToUpper(serv.cfg.Announce.Command), announcement.Channel, text)
+	if serv.cfg.Announce.FileTag {
+		line = "@+draft/file=" + escapeTagValue(link) + " " + line
+	}
+	announcement.Line = stripLineBreaks(line)
+	return announcement, nil
+}
+
+// escapeTagValue escapes a message tag value as defined by the IRCv3 message-tags spec
+func escapeTagValue(value string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\:`,
+		" ", `\s`,
+		"\r", `\r`,
+		"\n", `\n`,
+	).Replace(value)
+}
+
+// stripLineBreaks keeps client supplied values, such as filenames, from adding IRC lines
+func stripLineBreaks(line string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == 0 {
+			return ' '
+		}
+		return r
+	}, line)
+}
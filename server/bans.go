@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// ErrBanned occurs when a banned client makes a request
+var ErrBanned = errors.New("Your address has been banned from this server")
+
+// banList caches the active bans of the store, reloading them periodically
+type banList struct {
+	mu        sync.Mutex
+	store     *shardedfilestore.ShardedFileStore
+	interval  time.Duration
+	bans      []banEntry
+	loadedAt  time.Time
+	loadError error
+}
+
+type banEntry struct {
+	network   *net.IPNet
+	expiresAt time.Time // zero when the ban is permanent
+}
+
+func newBanList(store *shardedfilestore.ShardedFileStore, interval time.Duration) *banList {
+	return &banList{
+		store:    store,
+		interval: interval,
+	}
+}
+
+// invalidate forces the bans to be reloaded on the next check
+func (bl *banList) invalidate() {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.loadedAt = time.Time{}
+}
+
+// isBanned reports whether the address is in a range that is currently banned
+func (bl *banList) isBanned(ip net.IP) (bool, error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(bl.loadedAt) >= bl.interval {
+		bl.loadError = bl.load()
+		bl.loadedAt = now
+	}
+	if bl.loadError != nil {
+		return false, bl.loadError
+	}
+
+	for _, ban := range bl.bans {
+		if ban.network.Contains(ip) && (ban.expiresAt.IsZero() || now.Before(ban.expiresAt)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (bl *banList) load() error {
+	bans, err := bl.store.ListBans()
+	if err != nil {
+		return err
+	}
+
+	bl.bans = bl.bans[:0]
+	for _, ban := range bans {
+		network, err := ban.Network()
+		if err != nil {
+			return err
+		}
+		entry := banEntry{network: network}
+		if ban.ExpiresAt != nil {
+			entry.expiresAt = time.Unix(*ban.ExpiresAt, 0)
+		}
+		bl.bans = append(bl.bans, entry)
+	}
+	return nil
+}
+
+// ParseBanRange accepts an IP address or a CIDR range
+func ParseBanRange(str string) (*net.IPNet, error) {
+	if !strings.Contains(str, "/") {
+		ip := net.ParseIP(str)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address %#v", str)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(str)
+	return network, err
+}
+
+// banGuard refuses requests from banned clients
+func (serv *UploadServer) banGuard(next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		remoteIP, err := serv.getDirectOrForwardedRemoteIP(c.Request)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		banned, err := serv.bans.isBanned(net.ParseIP(remoteIP))
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+		if banned {
+			serv.log.Info().
+				Str("event", "banned_request").
+				Str("ip", remoteIP).
+				Str("method", c.Request.Method).
+				Msg("Refused request from banned client")
+			abortWithMessage(c, http.StatusForbidden, ErrBanned)
+			return
+		}
+
+		next(c)
+	}
+}
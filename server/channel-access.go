@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/extjwt"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// ErrChannelOnlyDisabled occurs when a client requests a channel-only upload while the
+// feature is disabled
+var ErrChannelOnlyDisabled = errors.New("Channel-only uploads are not enabled on this server")
+
+// ErrChannelTokenMissing occurs when a channel-only upload is made without a channel EXTJWT
+var ErrChannelTokenMissing = errors.New("Channel-only uploads require an EXTJWT for the channel")
+
+// ErrChannelTokenRequired occurs when a channel-only upload is downloaded without a token
+var ErrChannelTokenRequired = errors.New("This file is only available to members of the channel it was shared in")
+
+// ErrChannelTokenRejected occurs when the token presented for a channel-only upload is
+// invalid or for another channel
+var ErrChannelTokenRejected = errors.New("The EXTJWT presented does not grant access to this file")
+
+// enforceChannelBinding validates creation requests that ask for the upload to be
+// restricted to a channel. Must be called after processJwt.
+func (serv *UploadServer) enforceChannelBinding(req *http.Request) (status int, err error) {
+	metadata := parseMeta(req.Header.Get("Upload-Metadata"))
+	if _, ok := metadata["channelonly"]; !ok {
+		return 0, nil
+	}
+
+	if !serv.cfg.Server.ChannelOnlyUploads {
+		return http.StatusBadRequest, ErrChannelOnlyDisabled
+	}
+	if metadata["channel"] == "" {
+		return http.StatusBadRequest, ErrChannelTokenMissing
+	}
+
+	// the field is only checked for presence, normalize it for the store
+	metadata["channelonly"] = "1"
+	req.Header.Set("Upload-Metadata", serializeMeta(metadata))
+
+	return 0, nil
+}
+
+// channelAccessGuard wraps a GET handler and requires an EXTJWT for the channel an
+// upload is bound to, given as "Authorization: Bearer <token>" or the "token" query
+// parameter. Admin tokens are also accepted.
+func (serv *UploadServer) channelAccessGuard(getFile gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		binding, err := serv.store.GetChannelBinding(c.Param("id"))
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		if binding != nil && !hasAdminToken(c.Request, serv.cfg.Admin.Tokens) {
+			tokenString := requestToken(c)
+			if tokenString == "" {
+				abortWithMessage(c, http.StatusUnauthorized, ErrChannelTokenRequired)
+				return
+			}
+			if !serv.grantsChannelAccess(tokenString, binding) {
+				abortWithMessage(c, http.StatusForbidden, ErrChannelTokenRejected)
+				return
+			}
+		}
+
+		getFile(c)
+	}
+}
+
+// requestToken returns the EXTJWT presented with a download request, if any
+func requestToken(c *gin.Context) string {
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return ""
+}
+
+func (serv *UploadServer) grantsChannelAccess(tokenString string, binding *shardedfilestore.ChannelBinding) bool {
+	token, err := serv.jwtVerifier.Parse(tokenString)
+	if err != nil {
+		serv.log.Debug().
+			Err(err).
+			Str("event", "channel_token_rejected").
+			Msg("Invalid EXTJWT presented for channel-only upload")
+		return false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return false
+	}
+
+	issuer, _ := claims["iss"].(string)
+	channel, _ := claims["channel"].(string)
+	if issuer != binding.Issuer || !strings.EqualFold(channel, binding.Channel) {
+		return false
+	}
+
+	// the joined claim is zero when the user is not currently in the channel
+	if joined, ok, err := extjwt.Joined(claims); err != nil || (ok && !joined) {
+		return false
+	}
+
+	return true
+}
@@ -7,6 +7,8 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,17 +24,47 @@ type LoggerConfig struct {
 	Output logOutput
 }
 
+// JwtIssuerConfig holds the material used to verify tokens of an EXTJWT issuer
+type JwtIssuerConfig struct {
+	Secret        string `secret:"true"`
+	PublicKeyFile string
+	JwksFile      string
+	ExtJwtMode    extJwtMode
+	Audience      []string
+}
+
+// PolicyConfig overrides limits for uploads matching all of the given patterns
+type PolicyConfig struct {
+	Issuer            string
+	Account           string
+	Type              string
+	MaxAge            duration
+	IdentifiedMaxAge  duration
+	MaximumUploadSize datasize.ByteSize
+	Quota             datasize.ByteSize
+}
+
 type Config struct {
 	Server struct {
 		ListenAddress             string
+		TLSCert                   string
+		TLSKey                    string
+		RedirectAddress           string
+		ShutdownTimeout           duration
 		BasePath                  string
 		CorsOrigins               []string
 		TrustedReverseProxyRanges []ipnet
+		ExtJwtMode                extJwtMode
+		ExtJwtAudience            []string
+		ExtJwtClockSkew           duration
+		ExtJwtRejectReplays       bool
+		ChannelOnlyUploads        bool
 	}
 	Storage struct {
 		Path              string
 		ShardLayers       int
 		MaximumUploadSize datasize.ByteSize
+		Quota             datasize.ByteSize
 	}
 	Database struct {
 		Type string
@@ -42,9 +74,59 @@ type Config struct {
 		MaxAge           duration
 		IdentifiedMaxAge duration
 		CheckInterval    duration
+		BatchSize        int
+		Concurrency      int
+		HighWatermark    percentage
+		LowWatermark     percentage
+		EvictionOrder    string
+	}
+	RateLimit struct {
+		UploadsPerMinute        int
+		UploadBurst             int
+		AccountUploadsPerMinute int
+		AccountUploadBurst      int
+		BytesPerSecond          datasize.ByteSize
+		BytesBurst              datasize.ByteSize
+		AccountBytesPerSecond   datasize.ByteSize
+		AccountBytesBurst       datasize.ByteSize
+	}
+	Throttle struct {
+		UploadGlobal                    datasize.ByteSize
+		UploadPerConnection             datasize.ByteSize
+		IdentifiedUploadPerConnection   datasize.ByteSize
+		DownloadGlobal                  datasize.ByteSize
+		DownloadPerConnection           datasize.ByteSize
+		IdentifiedDownloadPerConnection datasize.ByteSize
+	}
+	Bans struct {
+		CheckDownloads  bool
+		RefreshInterval duration
+	}
+	Admin struct {
+		BasePath               string
+		Tokens                 []string `secret:"true"`
+		HeldDownloadsAdminOnly bool
+	}
+	Fetch struct {
+		Enabled       bool
+		Timeout       duration
+		MaxRedirects  int
+		AllowedTypes  []string
+		BlockedRanges []ipnet
+	}
+	Announce struct {
+		Enabled bool
+		Command string
+		FileTag bool
+		BaseURL string
+		Message string
 	}
-	JwtSecretsByIssuer map[string]string
+	JwtSecretsByIssuer map[string]string `secret:"true"`
+	JwtIssuers         map[string]JwtIssuerConfig
+	Policies           []PolicyConfig
 	Loggers            []LoggerConfig
+
+	sources *configSources // where values were set, for inspection
 }
 
 func NewConfig() *Config {
@@ -60,23 +142,17 @@ func NewConfig() *Config {
 	return cfg
 }
 
-func (cfg *Config) Load(log *zerolog.Logger, configPath string) (toml.MetaData, error) {
+// Load reads the config file, then applies the environment and command line overrides
+func (cfg *Config) Load(configPath string, overrides Overrides) (toml.MetaData, error) {
 	md, configLoadErr := toml.DecodeFile(configPath, cfg)
-	return md, configLoadErr
-}
-
-func (cfg *Config) DoPostLoadLogging(log *zerolog.Logger, configPath string, md toml.MetaData) {
-	undecoded := md.Undecoded()
-	if len(undecoded) > 0 {
-		var keys []string
-		for _, key := range undecoded {
-			keys = append(keys, key.String())
-		}
-		log.Warn().
-			Strs("keys", keys).
-			Msg("Extraneous configuration data")
+	if configLoadErr != nil {
+		return md, fmt.Errorf("%s: %v", configPath, configLoadErr)
 	}
+	cfg.sources = newConfigSources(md)
+	return md, cfg.applyOverrides(overrides)
+}
 
+func (cfg *Config) DoPostLoadLogging(log *zerolog.Logger, configPath string) {
 	if len(cfg.Server.TrustedReverseProxyRanges) > 0 {
 		ranges := []string{}
 		for _, rang := range cfg.Server.TrustedReverseProxyRanges {
@@ -88,35 +164,67 @@ func (cfg *Config) DoPostLoadLogging(log *zerolog.Logger, configPath string, md
 	}
 }
 
-func createMultiLogger(loggerConfigs []LoggerConfig) (*zerolog.Logger, error) {
-	var writers []io.Writer
+// addDiscoveredIssuers adds issuers along with their HMAC secret, unless they are already
+// configured. Returns the issuers added and those skipped.
+func (cfg *Config) addDiscoveredIssuers(secrets map[string]string) (added, skipped []string) {
+	for issuer, secret := range secrets {
+		_, inSecrets := cfg.JwtSecretsByIssuer[issuer]
+		_, inIssuers := cfg.JwtIssuers[issuer]
+		if inSecrets || inIssuers {
+			skipped = append(skipped, issuer)
+			continue
+		}
+		if secret == "" {
+			continue
+		}
+
+		if cfg.JwtIssuers == nil {
+			cfg.JwtIssuers = make(map[string]JwtIssuerConfig)
+		}
+		cfg.JwtIssuers[issuer] = JwtIssuerConfig{Secret: secret}
+		cfg.sources.set([]string{"JwtIssuers", issuer, "Secret"}, sourceDiscovered)
+		added = append(added, issuer)
+	}
+	sort.Strings(added)
+	sort.Strings(skipped)
+	return
+}
+
+// openLogOutput opens the destination of a logger
+func openLogOutput(output logOutput) (io.Writer, error) {
+	if output.URL == nil {
+		return nil, errors.New("missing log output")
+	}
+
+	url := output.URL
+
+	// "file:/path" is parsed into Path, "file:path" and "udp:host:port" into Opaque
+	target := url.Opaque
+	if target == "" {
+		target = url.Path
+	}
+
+	switch url.Scheme {
+	case "file":
+		return os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0640)
+	case "stderr":
+		return os.Stderr, nil
+	case "stdout":
+		return os.Stdout, nil
+	case "unix", "udp", "tcp":
+		return net.Dial(url.Scheme, target)
+	}
+	return nil, errors.New("invalid log url scheme: " + url.Scheme)
+}
+
+// createMultiLogger creates a logger writing to the configured outputs, and to any extra
+// writers given
+func createMultiLogger(loggerConfigs []LoggerConfig, extra ...io.Writer) (*zerolog.Logger, error) {
+	writers := extra
 	for _, loggerCfg := range loggerConfigs {
-		var output io.Writer
-		url := loggerCfg.Output.URL
-		switch url.Scheme {
-		case "file":
-			file, err := os.OpenFile(url.Opaque, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0640)
-			if err != nil {
-				return nil, err
-			}
-			output = file
-		case "stderr":
-			output = os.Stderr
-		case "stdout":
-			output = os.Stdout
-		case "unix":
-			fallthrough
-		case "udp":
-			fallthrough
-		case "tcp":
-			conn, err := net.Dial(url.Scheme, url.Opaque)
-			if err != nil {
-				return nil, err
-			}
-			output = conn
-		default:
-			fmt.Printf("working url %#v\n", url)
-			return nil, errors.New("invalid log url scheme: " + url.Scheme)
+		output, err := openLogOutput(loggerCfg.Output)
+		if err != nil {
+			return nil, err
 		}
 
 		switch loggerCfg.Format {
@@ -154,6 +262,10 @@ func (l *logLevel) UnmarshalText(text []byte) error {
 	return err
 }
 
+func (l logLevel) MarshalText() ([]byte, error) {
+	return []byte(l.Level.String()), nil
+}
+
 ////////////////////////////////////////////////////////////////
 
 type ipnet struct {
@@ -162,8 +274,15 @@ type ipnet struct {
 
 func (i *ipnet) UnmarshalText(text []byte) error {
 	_, cidr, err := net.ParseCIDR(string(text))
+	if err != nil {
+		return err
+	}
 	i.IPNet = *cidr
-	return err
+	return nil
+}
+
+func (i ipnet) MarshalText() ([]byte, error) {
+	return []byte(i.IPNet.String()), nil
 }
 
 ////////////////////////////////////////////////////////////////
@@ -178,6 +297,36 @@ func (d *duration) UnmarshalText(text []byte) error {
 	return err
 }
 
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+////////////////////////////////////////////////////////////////
+
+type percentage struct {
+	Fraction float64
+}
+
+func (p *percentage) UnmarshalText(text []byte) error {
+	str := strings.TrimSpace(string(text))
+	if !strings.HasSuffix(str, "%") {
+		return errors.New("Percentage must end with %: " + str)
+	}
+	value, err := strconv.ParseFloat(strings.TrimSuffix(str, "%"), 64)
+	if err != nil {
+		return err
+	}
+	if value < 0 || value > 100 {
+		return errors.New("Percentage out of range: " + str)
+	}
+	p.Fraction = value / 100
+	return nil
+}
+
+func (p percentage) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatFloat(p.Fraction*100, 'f', -1, 64) + "%"), nil
+}
+
 ////////////////////////////////////////////////////////////////
 
 type logFormat struct {
@@ -197,6 +346,38 @@ func (f *logFormat) UnmarshalText(text []byte) error {
 	return nil
 }
 
+func (f logFormat) MarshalText() ([]byte, error) {
+	return []byte(f.string), nil
+}
+
+////////////////////////////////////////////////////////////////
+
+// EXTJWT requirements for new uploads
+const (
+	extJwtModeOff                = "off"
+	extJwtModeIdentifiedOnly     = "identified-only"
+	extJwtModeValidTokenRequired = "valid-token-required"
+)
+
+type extJwtMode struct {
+	string
+}
+
+func (m *extJwtMode) UnmarshalText(text []byte) error {
+	modeStr := string(text)
+	switch modeStr {
+	case extJwtModeOff, extJwtModeIdentifiedOnly, extJwtModeValidTokenRequired:
+		m.string = modeStr
+	default:
+		return errors.New("Unsupported EXTJWT mode: " + modeStr)
+	}
+	return nil
+}
+
+func (m extJwtMode) MarshalText() ([]byte, error) {
+	return []byte(m.string), nil
+}
+
 ////////////////////////////////////////////////////////////////
 
 type logOutput struct {
@@ -212,3 +393,10 @@ func (o *logOutput) UnmarshalText(text []byte) error {
 	o.URL = u
 	return nil
 }
+
+func (o logOutput) MarshalText() ([]byte, error) {
+	if o.URL == nil {
+		return nil, nil
+	}
+	return []byte(o.URL.String()), nil
+}
@@ -6,6 +6,21 @@ const defaultConfig = `
 # those situations, the listen addresses of the webircgateway will be used,
 # including HTTPS if configured.
 ListenAddress = "127.0.0.1:8088"
+# ListenAddress = "unix:/run/fileuploader/fileuploader.sock"
+
+# Serve HTTPS with this certificate and key, reloaded on SIGHUP. Not used when
+# running as a webircgateway plugin.
+TLSCert = ""
+TLSKey = ""
+# TLSCert = "/etc/fileuploader/fullchain.pem"
+# TLSKey = "/etc/fileuploader/privkey.pem"
+# With TLS enabled, plain HTTP requests to this address are redirected to HTTPS
+RedirectAddress = ""
+# RedirectAddress = ":80"
+
+# How long outstanding requests are given to complete on shutdown or reload. New
+# requests to a server that is shutting down are refused with a Retry-After header.
+ShutdownTimeout = "30s"
 
 # When running as a webircgateway plugin, this path will be relative to the
 # webircgateway domain, e.g. https://ws.irc.example.com/files
@@ -30,10 +45,31 @@ TrustedReverseProxyRanges = [
 	"::1/128",
 ]
 
+# Whether uploads require an EXTJWT. Can be overridden per issuer in [JwtIssuers].
+#   off:                  anonymous uploads are accepted
+#   valid-token-required: a token from a configured issuer is required
+#   identified-only:      the token must also include a services account
+ExtJwtMode = "off"
+# Accepted values of the EXTJWT "aud" claim. When not empty, tokens must contain one
+# of them. Can be overridden per issuer in [JwtIssuers].
+ExtJwtAudience = []
+# Clock skew tolerated when checking the "exp", "nbf" and "iat" claims
+ExtJwtClockSkew = "30s"
+# Reject tokens whose "jti" claim has been seen before. Tokens must then include "jti"
+# and "exp", and clients must request a fresh token for every upload.
+ExtJwtRejectReplays = false
+# Allow uploads made with a channel EXTJWT to be restricted to that channel, by
+# including the "channelonly" metadata field. Downloading them then requires a
+# valid EXTJWT for the same channel and issuer.
+ChannelOnlyUploads = false
+
 [Storage]
 Path = "./uploads"
 ShardLayers = 6
 MaximumUploadSize = "10 MB" # accepts units such as: MB, g, tB, peta, kilobytes, gigabyte
+# Total size of live uploads allowed per EXTJWT account, or per IP for anonymous
+# uploads. "0" for unlimited.
+Quota = "0"
 
 [Database]
 Type = "sqlite3" # sqlite3 | mysql
@@ -47,6 +83,102 @@ Path = "./uploads.db"
 MaxAge = "24h" # 1 day
 IdentifiedMaxAge = "168h" # 1 week
 CheckInterval = "5m"
+BatchSize = 500 # expired uploads fetched from the database at a time
+Concurrency = 4 # expired uploads deleted in parallel
+
+# Disk pressure eviction. When usage of the volume holding Storage.Path rises
+# above HighWatermark, uploads are evicted until usage drops below LowWatermark.
+# Anonymous uploads are evicted before those with an identified account. Uploads
+# still in progress are left to expire instead. New uploads are refused while
+# eviction cannot bring usage under HighWatermark.
+# Set HighWatermark to "0%" to disable.
+HighWatermark = "0%"
+LowWatermark = "0%"
+# HighWatermark = "90%"
+# LowWatermark = "80%"
+EvictionOrder = "oldest" # oldest | least-recently-downloaded
+
+[RateLimit]
+# Token bucket limits, per client IP and per EXTJWT account. Clients exceeding them
+# receive "429 Too Many Requests" with a Retry-After header. A rate of 0 disables the
+# limit, bursts are the amount allowed in quick succession.
+#
+# Creation of new uploads
+UploadsPerMinute = 0
+UploadBurst = 10
+AccountUploadsPerMinute = 0
+AccountUploadBurst = 10
+# Upload data sent with PATCH requests
+BytesPerSecond = "0"
+BytesBurst = "50 MB"
+AccountBytesPerSecond = "0"
+AccountBytesBurst = "50 MB"
+
+[Throttle]
+# Bandwidth caps in bytes per second, "0" for unlimited. Global caps are shared by all
+# connections, the others apply to each connection. The identified caps apply instead
+# to uploads made with an EXTJWT account, and to downloads presenting an EXTJWT with an
+# account; they fall back to the per-connection caps when "0".
+UploadGlobal = "0"
+UploadPerConnection = "0"
+IdentifiedUploadPerConnection = "0"
+DownloadGlobal = "0"
+DownloadPerConnection = "0"
+IdentifiedDownloadPerConnection = "0"
+
+[Bans]
+# Banned IP addresses and ranges are managed with the admin API or the "ban" command.
+# Uploads from banned clients are always refused, downloads only when enabled here.
+CheckDownloads = false
+# How often the ban list is reloaded from the database, to pick up changes made from
+# the command line or by other instances
+RefreshInterval = "30s"
+
+[Admin]
+# The admin API is enabled when at least one token is configured. Requests must
+# include an "Authorization: Bearer <token>" header with one of the tokens.
+#
+# When running as a webircgateway plugin, this path will be relative to the
+# webircgateway domain, e.g. https://ws.irc.example.com/files-admin
+BasePath = "/files-admin"
+Tokens = []
+# Tokens = [ "a-long-random-string" ]
+
+# Uploads under hold are protected from expiry and deletion. When enabled, they can
+# only be downloaded with an admin token.
+HeldDownloadsAdminOnly = false
+
+[Fetch]
+# Allows clients to upload a file by URL with POST <BasePath>/fetch, which the server
+# downloads into a new upload
+Enabled = false
+# Time allowed for downloading the file, including redirects
+Timeout = "30s"
+MaxRedirects = 5
+# Accepted content types, as prefixes. All types are accepted when empty.
+AllowedTypes = [ "image/", "video/", "audio/" ]
+# The server never connects to loopback, private, link-local and other special purpose
+# addresses, or to the TrustedReverseProxyRanges. More networks can be blocked here.
+BlockedRanges = []
+# BlockedRanges = [ "203.0.113.0/24" ]
+
+[Announce]
+# When running as a webircgateway plugin, uploads including the "announce" metadata
+# field are announced to the channel it names, as a message sent by the uploader's own
+# connection. The upload must be made with an EXTJWT for that channel showing the
+# uploader has joined it, and the uploader must still be in the channel when the upload
+# finishes. Not used in standalone mode.
+Enabled = false
+# NOTICE | PRIVMSG
+Command = "NOTICE"
+# Also attach the download URL as a "+draft/file" message tag. Only enable this when the
+# IRC network supports client tags.
+FileTag = false
+# Absolute URL of BasePath used in download links, required when BasePath is a path
+BaseURL = ""
+# BaseURL = "https://ws.irc.example.com/files"
+# Available placeholders: {nick} {filename} {size} {url}
+Message = "{nick} shared {filename} ({size}): {url}"
 
 # If EXTJWT is supported by the gateway or network, a validated token with an account present (when
 # the user is authenticated to an irc services account) will use the IdentifiedMaxAge setting above
@@ -55,11 +187,50 @@ CheckInterval = "5m"
 # The HMAC secret used to sign the token is needed here to be able to validate the token.
 #
 # When using a webircgateway, the issuer will be the network_common_address of the upstream server
-# if set. Otherwise it will be the hostname used to connect to the network.
+# if set. Otherwise it will be the hostname used to connect to the network. When running as a
+# webircgateway plugin, the upstreams and secret of the gateway are added automatically, unless
+# the issuer is configured here or in [JwtIssuers].
 [JwtSecretsByIssuer]
 # "example.com" = "examplesecret"
 # "169.254.0.0" = "anothersecret"
 
+# Issuers can also be verified with public keys (RS256, ES256, EdDSA, ...) so that no
+# shared secret is needed. Keys are read from a PEM file of public keys or certificates,
+# or from a JSON Web Key Set, and are reloaded along with the config on SIGHUP. When an
+# issuer has several keys, the "kid" header of the token selects the key.
+#
+# [JwtIssuers."example.net"]
+# PublicKeyFile = "/etc/fileuploader/example.net.pem"
+#
+# [JwtIssuers."example.org"]
+# JwksFile = "/etc/fileuploader/example.org.jwks.json"
+#
+# [JwtIssuers."example.com"]
+# Secret = "examplesecret" # equivalent to an entry in JwtSecretsByIssuer
+# ExtJwtMode = "identified-only" # overrides Server.ExtJwtMode for tokens from this issuer
+# Audience = ["files.example.com"] # overrides Server.ExtJwtAudience for tokens from this issuer
+
+# Retention policies override MaxAge, IdentifiedMaxAge, MaximumUploadSize and Quota for
+# uploads matching all the given patterns. Patterns are matched against the EXTJWT issuer
+# and account, and the MIME type of the upload, using shell glob syntax. Omitted patterns
+# match anything. The first matching policy applies, uploads matching none use the
+# global settings. Omitted limits also fall back to the global settings.
+#
+# The MIME type is declared by the uploader, who can choose any type to match a policy.
+# Type patterns are therefore advisory: a policy with a Type should not grant more than
+# the uploader would get without it.
+#
+# [[Policies]]
+# Issuer = "example.com"
+# Type = "video/*"
+# MaximumUploadSize = "2 MB"
+#
+# [[Policies]]
+# Issuer = "example.com"
+# MaxAge = "48h"
+# IdentifiedMaxAge = "720h"
+# Quota = "1 GB"
+
 [[Loggers]]
 Level = "info" # debug | info | warn | error | fatal | panic
 Format = "json" # pretty | json
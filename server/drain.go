@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrDraining occurs when a request arrives while the server is shutting down
+var ErrDraining = errors.New("Server is restarting, please try again shortly")
+
+// how long clients are asked to wait before retrying requests refused while draining
+const drainRetryAfter = 5 * time.Second
+
+// activityTracker counts units of work that must complete before the resources they
+// use are released. Once closed, no new work can begin.
+type activityTracker struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// begin registers a unit of work, returns false once the tracker is closed
+func (t *activityTracker) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *activityTracker) end() {
+	t.wg.Done()
+}
+
+// close refuses new work and waits for the active work to complete, or the context
+// to be done
+func (t *activityTracker) close(ctx context.Context) error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackRequests counts in-flight requests so that Shutdown can wait for them. Requests
+// arriving while draining are refused with a Retry-After header.
+func (serv *UploadServer) trackRequests(c *gin.Context) {
+	if !serv.requests.begin() {
+		c.Header("Retry-After", strconv.Itoa(int(drainRetryAfter.Seconds())))
+		abortWithMessage(c, http.StatusServiceUnavailable, ErrDraining)
+		return
+	}
+	defer serv.requests.end()
+
+	c.Next()
+}
+
+// background runs fn in a goroutine that Shutdown waits for before closing the
+// database. fn is skipped once the server has been shut down.
+func (serv *UploadServer) background(fn func()) {
+	if !serv.backgroundTasks.begin() {
+		return
+	}
+	go func() {
+		defer serv.backgroundTasks.end()
+		fn()
+	}()
+}
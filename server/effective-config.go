@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Sources of config values
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+
+	// issuers added by the host application, see RunContext.SetIssuerDiscovery
+	sourceDiscovered = "discovered"
+)
+
+const redacted = "<redacted>"
+
+// configSources records which values were set by the config file and by overrides
+type configSources struct {
+	file      map[string]bool   // lower case keys defined in the file
+	overrides map[string]string // source by path
+}
+
+func newConfigSources(md toml.MetaData) *configSources {
+	sources := &configSources{
+		file:      make(map[string]bool),
+		overrides: make(map[string]string),
+	}
+	for _, key := range md.Keys() {
+		sources.file[strings.ToLower(strings.Join(key, "\x00"))] = true
+	}
+	return sources
+}
+
+func (sources *configSources) set(path []string, source string) {
+	if sources != nil {
+		sources.overrides[strings.Join(path, "\x00")] = source
+	}
+}
+
+// lookup returns the source of the value at the path
+func (sources *configSources) lookup(path []string) string {
+	if sources == nil {
+		return sourceDefault
+	}
+	if source, ok := sources.overrides[strings.Join(path, "\x00")]; ok {
+		return source
+	}
+
+	// lists of tables in the file replace the default list as a whole, and their
+	// keys do not include the index
+	var fileKey []string
+	for _, segment := range path {
+		if _, err := strconv.Atoi(segment); err == nil {
+			break
+		}
+		fileKey = append(fileKey, segment)
+	}
+	if sources.file[strings.ToLower(strings.Join(fileKey, "\x00"))] {
+		return sourceFile
+	}
+	return sourceDefault
+}
+
+// ConfigSetting is a value of the effective config and where it was set
+type ConfigSetting struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// Settings lists every value of the config along with its source. Secrets are redacted.
+func (cfg *Config) Settings() []ConfigSetting {
+	var settings []ConfigSetting
+	var walk func(v reflect.Value, path []string, secret bool)
+	walk = func(v reflect.Value, path []string, secret bool) {
+		if isLeaf(v.Type()) {
+			value := formatSetting(v)
+			if secret && value != "" && value != "[]" {
+				value = redacted
+			}
+			settings = append(settings, ConfigSetting{
+				Key:    formatSettingKey(path),
+				Value:  value,
+				Source: cfg.sources.lookup(path),
+			})
+			return
+		}
+
+		switch v.Kind() {
+		case reflect.Struct:
+			for i := 0; i < v.NumField(); i++ {
+				field := v.Type().Field(i)
+				if field.PkgPath == "" {
+					walk(v.Field(i), appendPath(path, field.Name), secret || field.Tag.Get("secret") == "true")
+				}
+			}
+		case reflect.Map:
+			var keys []string
+			for _, key := range v.MapKeys() {
+				keys = append(keys, key.String())
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				walk(v.MapIndex(reflect.ValueOf(key)), appendPath(path, key), secret)
+			}
+		case reflect.Slice:
+			for i := 0; i < v.Len(); i++ {
+				walk(v.Index(i), appendPath(path, strconv.Itoa(i)), secret)
+			}
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), nil, false)
+
+	// DSNs of mysql contain a password
+	for i := range settings {
+		if settings[i].Key == "Database.Path" && cfg.Database.Type == "mysql" {
+			settings[i].Value = redactDSN(cfg.Database.Path)
+		}
+	}
+
+	return settings
+}
+
+func appendPath(path []string, segment string) []string {
+	return append(append([]string(nil), path...), segment)
+}
+
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// formatSettingKey formats a path like Loggers[0].Output or JwtIssuers."example.com".Secret
+func formatSettingKey(path []string) string {
+	var key strings.Builder
+	for i, segment := range path {
+		if _, err := strconv.Atoi(segment); err == nil && i > 0 {
+			key.WriteString("[" + segment + "]")
+			continue
+		}
+		if i > 0 {
+			key.WriteString(".")
+		}
+		if bareKey.MatchString(segment) {
+			key.WriteString(segment)
+		} else {
+			key.WriteString(strconv.Quote(segment))
+		}
+	}
+	return key.String()
+}
+
+func formatSetting(v reflect.Value) string {
+	if marshaler, ok := v.Interface().(encoding.TextMarshaler); ok {
+		text, err := marshaler.MarshalText()
+		if err != nil {
+			return err.Error()
+		}
+		return string(text)
+	}
+	if v.Kind() == reflect.Slice {
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = formatSetting(v.Index(i))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// redactDSN hides the password of a mysql DSN
+func redactDSN(dsn string) string {
+	parsed, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return redacted
+	}
+	if parsed.Passwd != "" {
+		parsed.Passwd = redacted
+	}
+	return parsed.FormatDSN()
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrExtJwtRequired occurs when an upload without a valid EXTJWT is refused
+var ErrExtJwtRequired = errors.New("Uploading requires a valid EXTJWT. Please reconnect to the network and try again")
+
+// ErrAccountRequired occurs when an upload without a services account is refused
+var ErrAccountRequired = errors.New("Uploading is restricted to registered users. Please log in to your account and try again")
+
+// RejectedIssuerError occurs when an upload's EXTJWT is from an issuer that is not configured
+// while a valid token is required
+type RejectedIssuerError struct {
+	Issuer string
+}
+
+func (e RejectedIssuerError) Error() string {
+	return fmt.Sprintf("Uploading requires a valid EXTJWT, but tokens from %#v are not accepted by this server", e.Issuer)
+}
+
+// abortWithMessage responds with the error as a plain text body that upload clients can display
+func abortWithMessage(c *gin.Context, status int, err error) {
+	c.Error(err).SetType(gin.ErrorTypePublic)
+	c.String(status, err.Error())
+	c.Abort()
+}
+
+// extJwtModeFor returns the EXTJWT mode applying to tokens from the issuer
+func (serv *UploadServer) extJwtModeFor(issuer string) string {
+	if issuerCfg, ok := serv.cfg.JwtIssuers[issuer]; ok && issuerCfg.ExtJwtMode.string != "" {
+		return issuerCfg.ExtJwtMode.string
+	}
+	if serv.cfg.Server.ExtJwtMode.string != "" {
+		return serv.cfg.Server.ExtJwtMode.string
+	}
+	return extJwtModeOff
+}
+
+// enforceExtJwtMode rejects creation requests that don't satisfy the configured EXTJWT mode.
+// Must be called after processJwt, with the non-fatal error it returned if any.
+func (serv *UploadServer) enforceExtJwtMode(req *http.Request, jwtErr error) (status int, err error) {
+	metadata := parseMeta(req.Header.Get("Upload-Metadata"))
+	issuer := metadata["issuer"]
+
+	mode := serv.extJwtModeFor(issuer)
+	if mode == extJwtModeOff {
+		return 0, nil
+	}
+
+	if issuer == "" {
+		if unknownIssuerErr := asUnknownIssuerError(jwtErr); unknownIssuerErr != nil {
+			return http.StatusForbidden, &RejectedIssuerError{Issuer: unknownIssuerErr.Issuer}
+		}
+		return http.StatusUnauthorized, ErrExtJwtRequired
+	}
+
+	if mode == extJwtModeIdentifiedOnly && metadata["account"] == "" {
+		return http.StatusForbidden, ErrAccountRequired
+	}
+
+	return 0, nil
+}
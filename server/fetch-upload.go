@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/fetcher"
+	"github.com/kiwiirc/plugin-fileuploader/policy"
+	"github.com/tus/tusd"
+)
+
+// fetchUploadPath is the route of uploads fetched from a URL, relative to BasePath
+const fetchUploadPath = "fetch"
+
+// ErrFetchURLMissing occurs when a fetch upload has no "url" field
+var ErrFetchURLMissing = errors.New(`The "url" field is missing`)
+
+// newFetcher creates the fetcher of remote uploads. Besides the configured ranges, it
+// never connects to special purpose addresses or to the trusted reverse proxies.
+func newFetcher(cfg *Config, policies *policy.Table) *fetcher.Fetcher {
+	blocked := append([]*net.IPNet{}, fetcher.SpecialPurposeRanges...)
+	for i := range cfg.Server.TrustedReverseProxyRanges {
+		blocked = append(blocked, &cfg.Server.TrustedReverseProxyRanges[i].IPNet)
+	}
+	for i := range cfg.Fetch.BlockedRanges {
+		blocked = append(blocked, &cfg.Fetch.BlockedRanges[i].IPNet)
+	}
+
+	return fetcher.New(fetcher.Config{
+		Timeout:      cfg.Fetch.Timeout.Duration,
+		MaxRedirects: cfg.Fetch.MaxRedirects,
+		MaxSize:      policies.LargestUploadSize(),
+		AllowedTypes: cfg.Fetch.AllowedTypes,
+		Blocked:      blocked,
+	})
+}
+
+// fetchResponseKey is the context key of the response fetched by fetchUpload
+const fetchResponseKey = "fetchResponse"
+
+// fetchUpload handles uploads of the file at the "url" form field or query parameter.
+// The uploader is checked before anything is fetched. The fetched data then replaces
+// the request body, so that the byte rate limits and throttles wrapping storeFetched
+// apply to it.
+func (serv *UploadServer) fetchUpload(storeFetched gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := c.Request
+		if err := req.ParseForm(); err != nil {
+			abortWithMessage(c, http.StatusBadRequest, err)
+			return
+		}
+		rawURL, _ := simpleUploadField(c, "url")
+		if rawURL == "" {
+			abortWithMessage(c, http.StatusBadRequest, ErrFetchURLMissing)
+			return
+		}
+
+		metadata := make(map[string]string)
+		addClientFields(c, metadata)
+		// the size is not known before fetching, so only uploaders already over their
+		// quota are rejected here
+		setCreationHeaders(req, metadata, 0)
+		if !serv.checkUploadCreation(c) {
+			return
+		}
+
+		resp, err := serv.fetcher.Fetch(req.Context(), rawURL)
+		if err != nil {
+			serv.abortFetch(c, rawURL, err)
+			return
+		}
+		defer resp.Body.Close()
+
+		req.Body = resp.Body
+		c.Set(fetchResponseKey, resp)
+		storeFetched(c)
+	}
+}
+
+// storeFetched downloads the file fetched by fetchUpload to a temporary file before the
+// upload is created, so that policies apply to its final size and type
+func (serv *UploadServer) storeFetched(handler *tusd.UnroutedHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := c.Request
+		resp := c.MustGet(fetchResponseKey).(*fetcher.Response)
+		rawURL, _ := simpleUploadField(c, "url")
+
+		file, size, err := spool(req.Body)
+		if err != nil {
+			serv.abortFetch(c, rawURL, err)
+			return
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+
+		// processJwt has added the identity of the uploader to the metadata
+		metadata := parseMeta(req.Header.Get("Upload-Metadata"))
+		if resp.Filename != "" {
+			metadata["filename"] = resp.Filename
+		}
+		if resp.ContentType != "" {
+			metadata["type"] = resp.ContentType
+		}
+		setCreationHeaders(req, metadata, size)
+		if !serv.checkPolicy(c) {
+			return
+		}
+
+		req.Body = file
+		serv.createSingleRequestUpload(c, handler, metadata)
+	}
+}
+
+// spool receives the body into a temporary file, returned with its size and rewound
+func spool(body io.ReadCloser) (*os.File, int64, error) {
+	defer body.Close()
+
+	file, err := ioutil.TempFile("", "fileuploader-spool")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(file, body)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+func (serv *UploadServer) abortFetch(c *gin.Context, rawURL string, err error) {
+	status := http.StatusBadGateway
+	switch err {
+	case fetcher.ErrInvalidURL, fetcher.ErrUnsupportedScheme:
+		status = http.StatusBadRequest
+	case fetcher.ErrBlockedAddress:
+		status = http.StatusForbidden
+	case fetcher.ErrTypeNotAllowed:
+		status = http.StatusUnsupportedMediaType
+	case fetcher.ErrTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case fetcher.ErrTimeout:
+		status = http.StatusGatewayTimeout
+	}
+
+	serv.log.Info().
+		Err(err).
+		Str("event", "fetch_rejected").
+		Str("url", rawURL).
+		Int("status", status).
+		Msg("Failed to fetch upload")
+
+	abortWithMessage(c, status, err)
+}
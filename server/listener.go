@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const unixAddressPrefix = "unix:"
+
+// listen opens a TCP listener, or a unix socket for addresses like "unix:/path/to.sock"
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixAddressPrefix) {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, unixAddressPrefix)
+
+	// remove a stale socket left behind by a previous instance
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+// certReloader serves the TLS certificate most recently loaded, so that certificates
+// can be replaced without restarting the listener
+type certReloader struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// load reads the certificate and key. The previous certificate stays in use on error.
+func (cr *certReloader) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// httpsRedirect redirects plain HTTP requests to the same URL on the TLS listener
+func httpsRedirect(tlsAddress string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddress)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+
+		target := "https://" + host + req.URL.RequestURI()
+		http.Redirect(w, req, target, http.StatusPermanentRedirect)
+	})
+}
+
+// standaloneServer is the HTTP server used when not mounted on a parent router. It
+// outlives config reloads, which only replace its handler and TLS certificate.
+type standaloneServer struct {
+	httpServer     *http.Server
+	redirectServer *http.Server
+	certs          *certReloader
+	listenAddress  string
+	redirectAddr   string
+	tls            bool
+}
+
+// startStandaloneServer opens the configured listeners and serves the handler on them.
+// Errors occurring while serving are sent to errChan.
+func startStandaloneServer(cfg *Config, handler http.Handler, errChan chan<- error) (*standaloneServer, error) {
+	ss := &standaloneServer{
+		httpServer:    &http.Server{Handler: handler},
+		listenAddress: cfg.Server.ListenAddress,
+		redirectAddr:  cfg.Server.RedirectAddress,
+		tls:           cfg.Server.TLSCert != "",
+	}
+
+	if ss.tls {
+		ss.certs = &certReloader{}
+		if err := ss.certs.load(cfg.Server.TLSCert, cfg.Server.TLSKey); err != nil {
+			return nil, err
+		}
+		ss.httpServer.TLSConfig = &tls.Config{
+			GetCertificate: ss.certs.getCertificate,
+		}
+	}
+
+	listener, err := listen(ss.listenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	var redirectListener net.Listener
+	if ss.tls && ss.redirectAddr != "" {
+		redirectListener, err = listen(ss.redirectAddr)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		ss.redirectServer = &http.Server{Handler: httpsRedirect(ss.listenAddress)}
+	}
+
+	go func() {
+		if ss.tls {
+			errChan <- ss.httpServer.ServeTLS(listener, "", "")
+		} else {
+			errChan <- ss.httpServer.Serve(listener)
+		}
+	}()
+	if redirectListener != nil {
+		go func() {
+			errChan <- ss.redirectServer.Serve(redirectListener)
+		}()
+	}
+
+	return ss, nil
+}
+
+// reload applies the settings of a reloaded config that can be changed live, and
+// returns the names of those that require a restart
+func (ss *standaloneServer) reload(cfg *Config) (needRestart []string, err error) {
+	if cfg.Server.ListenAddress != ss.listenAddress {
+		needRestart = append(needRestart, "Server.ListenAddress")
+	}
+	if cfg.Server.RedirectAddress != ss.redirectAddr {
+		needRestart = append(needRestart, "Server.RedirectAddress")
+	}
+	if (cfg.Server.TLSCert != "") != ss.tls {
+		needRestart = append(needRestart, "Server.TLSCert")
+	}
+
+	if ss.tls && cfg.Server.TLSCert != "" {
+		err = ss.certs.load(cfg.Server.TLSCert, cfg.Server.TLSKey)
+	}
+	return
+}
+
+// shutdown stops accepting connections and waits for outstanding requests. Connections
+// still open when the context is done are closed.
+func (ss *standaloneServer) shutdown(ctx context.Context) {
+	if ss.redirectServer != nil {
+		ss.redirectServer.Shutdown(ctx)
+	}
+	if err := ss.httpServer.Shutdown(ctx); err != nil {
+		ss.httpServer.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/expirer"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+	"github.com/rs/zerolog"
+)
+
+// MaintenanceContext gives command line tools access to the storage of a configured
+// server without starting it
+type MaintenanceContext struct {
+	Config  *Config
+	Log     *zerolog.Logger
+	DBConn  *db.DatabaseConnection
+	Store   *shardedfilestore.ShardedFileStore
+	Expirer *expirer.Expirer
+}
+
+// NewMaintenanceContext loads the config file and opens the configured database and store
+func NewMaintenanceContext(configPath string, overrides Overrides) (*MaintenanceContext, error) {
+	cfg, err := LoadConfig(configPath, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := createMultiLogger(cfg.Loggers)
+	if err != nil {
+		return nil, err
+	}
+
+	dbConn := db.ConnectToDB(log, db.DBConfig{
+		DriverName: cfg.Database.Type,
+		DSN:        cfg.Database.Path,
+	})
+
+	store := shardedfilestore.New(
+		cfg.Storage.Path,
+		cfg.Storage.ShardLayers,
+		dbConn,
+		log,
+	)
+
+	// periodic collection is not wanted here, runs are triggered explicitly
+	expirerConfig := newExpirerConfig(cfg)
+	expirerConfig.CheckInterval = 0
+
+	return &MaintenanceContext{
+		Config:  cfg,
+		Log:     log,
+		DBConn:  dbConn,
+		Store:   store,
+		Expirer: expirer.New(store, expirerConfig, log),
+	}, nil
+}
+
+// Close releases the resources held by the MaintenanceContext
+func (mc *MaintenanceContext) Close() {
+	mc.Expirer.Stop()
+	mc.DBConn.DB.Close()
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"encoding"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envPrefix starts the names of environment variables overriding config values, such
+// as FILEUPLOADER_DATABASE_PATH
+const envPrefix = "FILEUPLOADER_"
+
+// fileSuffix makes an override read its value from the file at the given path, which
+// keeps secrets out of the environment and process list
+const fileSuffix = "_FILE"
+
+// Overrides holds "section.key=value" settings given on the command line. It implements
+// flag.Value so that the flag can be repeated.
+type Overrides []string
+
+func (o *Overrides) String() string {
+	return strings.Join(*o, " ")
+}
+
+// Set adds an override
+func (o *Overrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("Expected section.key=value, got %#v", value)
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// applyOverrides sets the values of FILEUPLOADER_<SECTION>_<KEY> environment variables,
+// then those given on the command line
+func (cfg *Config) applyOverrides(overrides Overrides) error {
+	root := reflect.ValueOf(cfg).Elem()
+
+	environ := os.Environ()
+	sort.Strings(environ)
+	for _, variable := range environ {
+		if !strings.HasPrefix(variable, envPrefix) {
+			continue
+		}
+		pair := strings.SplitN(variable, "=", 2)
+		name, value := pair[0], pair[1]
+		key := strings.TrimPrefix(name, envPrefix)
+
+		var err error
+		if strings.HasSuffix(key, fileSuffix) {
+			key = strings.TrimSuffix(key, fileSuffix)
+			value, err = readSecretFile(value)
+		}
+		if err == nil {
+			path := resolveEnvKey(root, key)
+			if err = setOverride(root, path, value); err == nil {
+				cfg.sources.set(path, sourceEnv)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Environment variable %s: %v", name, err)
+		}
+	}
+
+	for _, override := range overrides {
+		pair := strings.SplitN(override, "=", 2)
+		key, value := pair[0], pair[1]
+
+		var err error
+		if strings.HasSuffix(strings.ToUpper(key), fileSuffix) {
+			key = key[:len(key)-len(fileSuffix)]
+			value, err = readSecretFile(value)
+		}
+		if err == nil {
+			var path []string
+			path, err = resolveKeyPath(root, splitKey(key))
+			if err == nil {
+				if err = setOverride(root, path, value); err == nil {
+					cfg.sources.set(path, sourceFlag)
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Override %#v: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+func readSecretFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// splitKey splits a dotted key, where segments containing dots can be quoted as in
+// jwtissuers."example.com".secret
+func splitKey(key string) (segments []string) {
+	var current strings.Builder
+	quoted := false
+	for _, r := range key {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == '.' && !quoted:
+			segments = append(segments, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(segments, current.String())
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// isLeaf reports whether values of the type are set as a whole
+func isLeaf(t reflect.Type) bool {
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return false
+	case reflect.Slice:
+		return isLeaf(t.Elem())
+	}
+	return true
+}
+
+// resolveKeyPath matches the segments of a dotted key to field names, map keys and list
+// indexes. Field names are matched case insensitively, like in the config file.
+func resolveKeyPath(v reflect.Value, segments []string) ([]string, error) {
+	if len(segments) == 0 {
+		if !isLeaf(v.Type()) {
+			return nil, fmt.Errorf("Not a single value")
+		}
+		return nil, nil
+	}
+
+	segment := segments[0]
+	switch {
+	case isLeaf(v.Type()):
+		// keys below a single value
+
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath == "" && strings.EqualFold(field.Name, segment) {
+				path, err := resolveKeyPath(v.Field(i), segments[1:])
+				return append([]string{field.Name}, path...), err
+			}
+		}
+
+	case v.Kind() == reflect.Map:
+		// missing keys add an entry
+		elem := v.MapIndex(reflect.ValueOf(segment))
+		if !elem.IsValid() {
+			elem = reflect.New(v.Type().Elem()).Elem()
+		}
+		path, err := resolveKeyPath(elem, segments[1:])
+		return append([]string{segment}, path...), err
+
+	case v.Kind() == reflect.Slice:
+		index, err := strconv.Atoi(segment)
+		if err == nil && index >= 0 && index < v.Len() {
+			path, err := resolveKeyPath(v.Index(index), segments[1:])
+			return append([]string{segment}, path...), err
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown key %#v", segment)
+}
+
+// envName converts a field name or map key to its form in environment variable names
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// resolveEnvKey matches the remainder of an environment variable name, such as
+// JWTISSUERS_EXAMPLE_COM_SECRET, to field names, map keys and list indexes. A map key
+// that does not exist yet is taken in lower case, as the shortest one leaving a valid
+// remainder. Returns nil when nothing matches.
+func resolveEnvKey(v reflect.Value, key string) []string {
+	if key == "" {
+		if isLeaf(v.Type()) {
+			return []string{}
+		}
+		return nil
+	}
+
+	try := func(name string, elem reflect.Value) []string {
+		prefix := envName(name)
+		var rest string
+		switch {
+		case key == prefix:
+		case strings.HasPrefix(key, prefix+"_"):
+			rest = key[len(prefix)+1:]
+		default:
+			return nil
+		}
+		if path := resolveEnvKey(elem, rest); path != nil {
+			return append([]string{name}, path...)
+		}
+		return nil
+	}
+
+	switch {
+	case isLeaf(v.Type()):
+
+	case v.Kind() == reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.PkgPath == "" {
+				if path := try(field.Name, v.Field(i)); path != nil {
+					return path
+				}
+			}
+		}
+
+	case v.Kind() == reflect.Map:
+		for _, mapKey := range v.MapKeys() {
+			if path := try(mapKey.String(), v.MapIndex(mapKey)); path != nil {
+				return path
+			}
+		}
+		// setOverride adds the entry, starting from a zero value
+		for i := 1; i <= len(key); i++ {
+			if i == len(key) || key[i] == '_' {
+				if path := try(strings.ToLower(key[:i]), reflect.New(v.Type().Elem()).Elem()); path != nil {
+					return path
+				}
+			}
+		}
+
+	case v.Kind() == reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if path := try(strconv.Itoa(i), v.Index(i)); path != nil {
+				return path
+			}
+		}
+	}
+
+	return nil
+}
+
+// setOverride parses the value into the setting at the resolved path
+func setOverride(v reflect.Value, path []string, value string) error {
+	if path == nil {
+		return fmt.Errorf("Unknown key")
+	}
+	if len(path) == 0 {
+		return setValue(v, value)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return setOverride(v.FieldByName(path[0]), path[1:], value)
+
+	case reflect.Map:
+		// map elements are not addressable, so a copy is modified and stored
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key := reflect.ValueOf(path[0])
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if existing := v.MapIndex(key); existing.IsValid() {
+			elem.Set(existing)
+		}
+		if err := setOverride(elem, path[1:], value); err != nil {
+			return err
+		}
+		v.SetMapIndex(key, elem)
+		return nil
+
+	case reflect.Slice:
+		index, _ := strconv.Atoi(path[0])
+		return setOverride(v.Index(index), path[1:], value)
+	}
+
+	return fmt.Errorf("Unknown key")
+}
+
+// setValue parses a single value. Lists are separated by commas.
+func setValue(v reflect.Value, value string) error {
+	if unmarshaler, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(value))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		list := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setValue(list.Index(i), item); err != nil {
+				return err
+			}
+		}
+		v.Set(list)
+
+	default:
+		return fmt.Errorf("Unsupported value type %s", v.Type())
+	}
+
+	return nil
+}
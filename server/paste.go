@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/highlight"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+	"github.com/tus/tusd"
+)
+
+// pastePath is the route of text pastes, relative to BasePath
+const pastePath = "paste"
+
+// pasteViewName is the filename segment of the page showing a text upload
+const pasteViewName = "view"
+
+// pasteViewPolicy keeps the view page from running scripts or loading anything but its
+// own styles
+const pasteViewPolicy = "default-src 'none'; style-src 'unsafe-inline'"
+
+// pasteViewLimit is the most text shown on a view page, longer texts link to the raw file
+const pasteViewLimit = 1 << 20
+
+// ErrPasteEmpty occurs when a paste has no content
+var ErrPasteEmpty = errors.New("The paste is empty")
+
+// ErrUnknownLanguage occurs when a paste has a language hint that is not supported
+var ErrUnknownLanguage = errors.New("Unknown language, supported languages are: " + strings.Join(highlight.Names(), ", "))
+
+// ErrUploadNotFound occurs when an upload does not exist or is incomplete
+var ErrUploadNotFound = errors.New("Upload not found")
+
+// ErrNotText occurs when viewing an upload that is not text
+var ErrNotText = errors.New("Only text uploads can be viewed")
+
+// textTypes are the types besides text/* that can be viewed
+var textTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/x-sh":       true,
+}
+
+// pasteUpload handles text given as the "content" form field or as the request body,
+// with an optional "language" hint. It is stored as a text/plain upload.
+func (serv *UploadServer) pasteUpload(handler *tusd.UnroutedHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := c.Request
+		if largest := serv.policies.LargestUploadSize(); largest > 0 {
+			req.Body = http.MaxBytesReader(c.Writer, req.Body, largest+multipartOverhead)
+		}
+
+		size, status, err := readPasteContent(req)
+		if err != nil {
+			abortWithMessage(c, status, err)
+			return
+		}
+		if req.MultipartForm != nil {
+			defer req.MultipartForm.RemoveAll()
+		}
+		if size == 0 {
+			abortWithMessage(c, http.StatusBadRequest, ErrPasteEmpty)
+			return
+		}
+
+		metadata := make(map[string]string)
+		addClientFields(c, metadata)
+		metadata["type"] = "text/plain"
+		metadata["filename"] = "paste.txt"
+
+		language, _ := simpleUploadField(c, "language")
+		switch strings.ToLower(language) {
+		case "", "text", "txt", "plain":
+		default:
+			lang := highlight.Lookup(language)
+			if lang == nil {
+				abortWithMessage(c, http.StatusBadRequest, ErrUnknownLanguage)
+				return
+			}
+			metadata["language"] = lang.Name
+			metadata["filename"] = "paste" + lang.Extension
+		}
+
+		setCreationHeaders(req, metadata, size)
+		if !serv.checkUploadCreation(c) {
+			return
+		}
+		serv.createSingleRequestUpload(c, handler, metadata)
+	}
+}
+
+// readPasteContent replaces the body of a form request with its "content" field, which
+// may also be a file. Other requests carry the text as their body.
+func readPasteContent(req *http.Request) (size int64, status int, err error) {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		if err := req.ParseMultipartForm(multipartMemory); err != nil {
+			return 0, http.StatusBadRequest, err
+		}
+		if file, header, err := req.FormFile("content"); err == nil {
+			req.Body = file
+			return header.Size, 0, nil
+		}
+	case "application/x-www-form-urlencoded":
+		if err := req.ParseForm(); err != nil {
+			return 0, http.StatusBadRequest, err
+		}
+	default:
+		if req.ContentLength < 0 {
+			return 0, http.StatusLengthRequired, ErrLengthRequired
+		}
+		return req.ContentLength, 0, nil
+	}
+
+	content := req.PostForm.Get("content")
+	req.Body = ioutil.NopCloser(strings.NewReader(content))
+	return int64(len(content)), 0, nil
+}
+
+// isText reports whether an upload can be shown as text
+func isText(metadata map[string]string) bool {
+	if metadata["language"] != "" {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(shardedfilestore.MimeType(metadata))
+	return strings.HasPrefix(mediaType, "text/") || textTypes[mediaType]
+}
+
+// uploadNamed reports whether the filename of an upload is name, so that a file named
+// like a page can still be downloaded by its name
+func (serv *UploadServer) uploadNamed(id, name string) bool {
+	info, err := serv.store.GetInfo(id)
+	return err == nil && info.MetaData["filename"] == name
+}
+
+type pasteView struct {
+	Filename  string
+	Language  string
+	Size      string
+	RawURL    string
+	Lines     []template.HTML
+	Truncated bool
+}
+
+// viewPaste renders a text upload with line numbers and syntax highlighting
+func (serv *UploadServer) viewPaste(c *gin.Context) {
+	id := c.Param("id")
+	info, err := serv.store.GetInfo(id)
+	if os.IsNotExist(err) || err == nil && (info.IsPartial || info.Offset != info.Size) {
+		abortWithMessage(c, http.StatusNotFound, ErrUploadNotFound)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	if !isText(info.MetaData) {
+		abortWithMessage(c, http.StatusUnsupportedMediaType, ErrNotText)
+		return
+	}
+
+	text, err := serv.readUpload(id, pasteViewLimit+1)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	view := pasteView{
+		Filename:  info.MetaData["filename"],
+		Size:      datasize.ByteSize(info.Size).HumanReadable(),
+		RawURL:    serv.downloadURL(c, id, info.MetaData["filename"], true),
+		Truncated: len(text) > pasteViewLimit,
+	}
+	if view.Truncated {
+		text = text[:pasteViewLimit]
+	}
+	lang := highlight.Lookup(info.MetaData["language"])
+	if lang != nil {
+		view.Language = lang.Name
+	}
+	view.Lines = lang.Lines(string(text))
+
+	var page bytes.Buffer
+	if err := pasteViewTemplate.Execute(&page, view); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	setPageHeaders(c, pasteViewPolicy)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
+
+// readUpload returns up to limit bytes of an upload
+func (serv *UploadServer) readUpload(id string, limit int64) ([]byte, error) {
+	reader, err := serv.store.GetReader(id)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	return ioutil.ReadAll(io.LimitReader(reader, limit))
+}
+
+// downloadURL returns the path of an upload. With withToken, the token given to the page
+// is kept so that channel-only uploads remain accessible.
+func (serv *UploadServer) downloadURL(c *gin.Context, id, filename string, withToken bool) string {
+	link := serv.pageURL(c, id, url.PathEscape(filename))
+	if !withToken {
+		link = strings.SplitN(link, "?", 2)[0]
+	}
+	return link
+}
+
+// pageURL returns the path of a page of an upload, keeping the token given to the
+// current page
+func (serv *UploadServer) pageURL(c *gin.Context, id, name string) string {
+	routePrefix, _ := routePrefixFromBasePath(serv.cfg.Server.BasePath)
+	link := path.Join(routePrefix, url.PathEscape(id))
+	if name != "" {
+		link += "/" + name
+	}
+	if token := c.Query("token"); token != "" {
+		link += "?token=" + url.QueryEscape(token)
+	}
+	return link
+}
+
+// setPageHeaders applies the content security policy of a page showing an upload
+func setPageHeaders(c *gin.Context, policy string) {
+	c.Header("Content-Security-Policy", policy)
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Referrer-Policy", "no-referrer")
+}
+
+var pasteViewTemplate = template.Must(template.New("paste").Funcs(template.FuncMap{
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Filename}}</title>
+<style>
+body { margin: 0; font-family: sans-serif; background: #fafafa; color: #222; }
+header { display: flex; gap: 1em; align-items: baseline; padding: 0.5em 1em; border-bottom: 1px solid #ddd; background: #fff; }
+header h1 { font-size: 1em; margin: 0; }
+header span { color: #666; font-size: 0.9em; }
+header a { margin-left: auto; }
+p.truncated { margin: 0; padding: 0.5em 1em; background: #fff3cd; }
+table { border-collapse: collapse; font-family: monospace; font-size: 0.9em; }
+td { padding: 0 1em; vertical-align: top; white-space: pre-wrap; word-break: break-all; }
+td.ln { text-align: right; color: #999; user-select: none; border-right: 1px solid #ddd; white-space: nowrap; }
+td.ln a { color: inherit; text-decoration: none; }
+tr:target { background: #fff3cd; }
+.k { color: #a626a4; font-weight: bold; }
+.s { color: #50a14f; }
+.c { color: #a0a1a7; font-style: italic; }
+.n { color: #986801; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Filename}}</h1>
+<span>{{if .Language}}{{.Language}}, {{end}}{{.Size}}</span>
+<a href="{{.RawURL}}">Raw</a>
+</header>
+{{if .Truncated}}<p class="truncated">Only the beginning of this paste is shown, open the raw file to see all of it.</p>{{end}}
+<table>
+{{range $i, $line := .Lines}}<tr id="L{{inc $i}}"><td class="ln"><a href="#L{{inc $i}}">{{inc $i}}</a></td><td>{{$line}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
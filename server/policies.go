@@ -0,0 +1,135 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/policy"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// ErrUploadTooLarge occurs when the declared upload length exceeds the applicable size limit
+var ErrUploadTooLarge = errors.New("Upload exceeds the maximum upload size")
+
+// ErrQuotaExceeded occurs when an upload would exceed the applicable storage quota
+var ErrQuotaExceeded = errors.New("Upload quota exceeded")
+
+// ErrUploadLengthMissing occurs when a creation request declares no Upload-Length
+var ErrUploadLengthMissing = errors.New("Upload-Length is missing or invalid")
+
+func newPolicyTable(cfg *Config) *policy.Table {
+	table := &policy.Table{
+		Defaults: policy.Limits{
+			MaxAge:            cfg.Expiration.MaxAge.Duration,
+			IdentifiedMaxAge:  cfg.Expiration.IdentifiedMaxAge.Duration,
+			MaximumUploadSize: int64(cfg.Storage.MaximumUploadSize.Bytes()),
+			Quota:             int64(cfg.Storage.Quota.Bytes()),
+		},
+	}
+	for _, p := range cfg.Policies {
+		table.Policies = append(table.Policies, policy.Policy{
+			Issuer:  p.Issuer,
+			Account: p.Account,
+			Type:    p.Type,
+			Limits: policy.Limits{
+				MaxAge:            p.MaxAge.Duration,
+				IdentifiedMaxAge:  p.IdentifiedMaxAge.Duration,
+				MaximumUploadSize: int64(p.MaximumUploadSize.Bytes()),
+				Quota:             int64(p.Quota.Bytes()),
+			},
+		})
+	}
+	return table
+}
+
+// checkPolicy applies enforcePolicy to a creation request. Returns false when the
+// request has been aborted.
+func (serv *UploadServer) checkPolicy(c *gin.Context) bool {
+	status, err := serv.enforcePolicy(c.Request)
+	if err == nil {
+		return true
+	}
+	if status == http.StatusInternalServerError {
+		c.AbortWithError(status, err).SetType(gin.ErrorTypePrivate)
+		return false
+	}
+	abortWithMessage(c, status, err)
+	return false
+}
+
+// enforcePolicy checks the size limit and quota of the policy matching a creation request.
+// Must be called after the RemoteIP and EXTJWT metadata have been added.
+func (serv *UploadServer) enforcePolicy(req *http.Request) (status int, err error) {
+	metadata := parseMeta(req.Header.Get("Upload-Metadata"))
+	limits := serv.policies.Lookup(metadata["issuer"], metadata["account"], shardedfilestore.MimeType(metadata))
+
+	length, status, err := serv.uploadLength(req)
+	if err != nil {
+		return status, err
+	}
+
+	if limits.MaximumUploadSize > 0 && length > limits.MaximumUploadSize {
+		return http.StatusRequestEntityTooLarge, ErrUploadTooLarge
+	}
+
+	if limits.Quota <= 0 {
+		return 0, nil
+	}
+
+	var used int64
+	if metadata["account"] != "" {
+		err = serv.DBConn.DB.Get(&used, `
+			SELECT COALESCE(SUM(size), 0) FROM uploads
+			WHERE jwt_issuer = ? AND jwt_account = ? AND deleted = 0
+		`, metadata["issuer"], metadata["account"])
+	} else {
+		err = serv.DBConn.DB.Get(&used, `
+			SELECT COALESCE(SUM(size), 0) FROM uploads
+			WHERE uploader_ip = ? AND jwt_account IS NULL AND deleted = 0
+		`, metadata["RemoteIP"])
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if used+length > limits.Quota {
+		return http.StatusForbidden, ErrQuotaExceeded
+	}
+
+	return 0, nil
+}
+
+// uploadLength returns the length of the upload a creation request declares. Final
+// concatenations are as long as their partial uploads together, which are kept and keep
+// counting towards the quota. The store does not support deferring the length.
+func (serv *UploadServer) uploadLength(req *http.Request) (length int64, status int, err error) {
+	concat := req.Header.Get("Upload-Concat")
+	if !strings.HasPrefix(concat, "final;") {
+		length, err = strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			return 0, http.StatusBadRequest, ErrUploadLengthMissing
+		}
+		return length, 0, nil
+	}
+
+	for _, partialURL := range strings.Fields(strings.TrimPrefix(concat, "final;")) {
+		var size int64
+		err = serv.DBConn.DB.Get(&size, `
+			SELECT COALESCE(size, 0) FROM uploads
+			WHERE id = ? AND deleted = 0
+		`, path.Base(partialURL))
+		if err == sql.ErrNoRows {
+			return 0, http.StatusNotFound, shardedfilestore.ErrUploadNotFound
+		}
+		if err != nil {
+			return 0, http.StatusInternalServerError, err
+		}
+		length += size
+	}
+	return length, 0, nil
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// previewTextLimit is the most text shown inline on a preview page
+const previewTextLimit = 64 << 10
+
+// previewScript counts down to the expiry of the upload. It is allowed by its hash, as
+// pages showing uploads do not run any other script.
+const previewScript = `(function () {
+	var el = document.getElementById("expiry");
+	if (!el) return;
+	var at = Date.parse(el.getAttribute("datetime"));
+	function update() {
+		var s = Math.max(0, Math.floor((at - Date.now()) / 1000));
+		var d = Math.floor(s / 86400), h = Math.floor(s % 86400 / 3600), m = Math.floor(s % 3600 / 60);
+		el.textContent = s === 0 ? "now" : (d ? d + "d " : "") + (d || h ? h + "h " : "") + m + "m " + s % 60 + "s";
+	}
+	update();
+	setInterval(update, 1000);
+})();`
+
+var previewScriptHash = sha256.Sum256([]byte(previewScript))
+
+var previewPolicy = "default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'; " +
+	"script-src 'sha256-" + base64.StdEncoding.EncodeToString(previewScriptHash[:]) + "'"
+
+type uploadRecord struct {
+	CreatedAt int64   `db:"created_at"`
+	Issuer    *string `db:"jwt_issuer"`
+	Account   *string `db:"jwt_account"`
+	MimeType  *string `db:"mime_type"`
+	Held      bool    `db:"held"`
+}
+
+type previewPage struct {
+	Filename    string
+	Type        string
+	Kind        string // image, video, audio, text or empty
+	Size        string
+	Description string
+	PageURL     string // absolute, for link previews
+	MediaURL    string // absolute, for link previews
+	RawURL      string
+	ViewURL     string
+	Text        string
+	Truncated   bool
+	UploadedAt  time.Time
+	ExpiresAt   time.Time // zero when held
+	ExpiresIn   string
+}
+
+// previewUpload renders a page describing an upload, with OpenGraph and Twitter card
+// tags for link previews and the content shown inline when the browser can display it
+func (serv *UploadServer) previewUpload(c *gin.Context) {
+	id := c.Param("id")
+	info, err := serv.store.GetInfo(id)
+	var record uploadRecord
+	if err == nil {
+		err = serv.DBConn.DB.Get(&record, `
+			SELECT created_at, jwt_issuer, jwt_account, mime_type, held FROM uploads
+			WHERE id = ? AND deleted = 0
+		`, id)
+	}
+	if isNotFound(err) || err == nil && (info.IsPartial || info.Offset != info.Size) {
+		abortWithMessage(c, http.StatusNotFound, ErrUploadNotFound)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	filename := info.MetaData["filename"]
+	page := previewPage{
+		Filename:   filename,
+		Type:       shardedfilestore.MimeType(info.MetaData),
+		Size:       datasize.ByteSize(info.Size).HumanReadable(),
+		PageURL:    serv.absoluteURL(c, serv.downloadURL(c, id, filename, false)+"?preview"),
+		MediaURL:   serv.absoluteURL(c, serv.downloadURL(c, id, filename, false)),
+		RawURL:     serv.downloadURL(c, id, filename, true),
+		UploadedAt: time.Unix(record.CreatedAt, 0).UTC(),
+	}
+	if page.Filename == "" {
+		page.Filename = id
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(page.Type)
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		page.Kind = "image"
+	case strings.HasPrefix(mediaType, "video/"):
+		page.Kind = "video"
+	case strings.HasPrefix(mediaType, "audio/"):
+		page.Kind = "audio"
+	case isText(info.MetaData):
+		page.Kind = "text"
+		page.ViewURL = serv.pageURL(c, id, pasteViewName)
+		text, err := serv.readUpload(id, previewTextLimit)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+		page.Text = string(text)
+		page.Truncated = info.Size > previewTextLimit
+	}
+
+	if !record.Held {
+		limits := serv.policies.Lookup(db.StringValue(record.Issuer), db.StringValue(record.Account), db.StringValue(record.MimeType))
+		page.ExpiresAt = page.UploadedAt.Add(limits.MaxAgeFor(record.Account != nil))
+		page.ExpiresIn = formatRemaining(time.Until(page.ExpiresAt))
+	}
+
+	page.Description = page.Size
+	if page.Type != "" {
+		page.Description = page.Type + ", " + page.Description
+	}
+	if !page.ExpiresAt.IsZero() {
+		page.Description += ", expires in " + page.ExpiresIn
+	}
+
+	var body bytes.Buffer
+	if err := previewTemplate.Execute(&body, page); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	setPageHeaders(c, previewPolicy)
+	c.Data(http.StatusOK, "text/html; charset=utf-8", body.Bytes())
+}
+
+func isNotFound(err error) bool {
+	return err == sql.ErrNoRows || os.IsNotExist(err)
+}
+
+// absoluteURL resolves a path against BasePath when it is a URL, or else against the
+// origin of the request, as forwarded by trusted reverse proxies
+func (serv *UploadServer) absoluteURL(c *gin.Context, p string) string {
+	if base, err := url.Parse(serv.cfg.Server.BasePath); err == nil && base.IsAbs() && base.Host != "" {
+		return base.Scheme + "://" + base.Host + p
+	}
+
+	req := c.Request
+	scheme, host := "http", req.Host
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if serv.peerIsTrusted(req) {
+		if proto := req.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwardedHost := req.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+	return scheme + "://" + host + p
+}
+
+// formatRemaining formats a duration like the countdown of the preview page
+func formatRemaining(d time.Duration) string {
+	s := int64(d / time.Second)
+	if s <= 0 {
+		return "now"
+	}
+	days, hours, minutes := s/86400, s%86400/3600, s%3600/60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh %dm %ds", days, hours, minutes, s%60)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm %ds", hours, minutes, s%60)
+	}
+	return fmt.Sprintf("%dm %ds", minutes, s%60)
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Filename}}</title>
+<meta name="description" content="{{.Description}}">
+<meta property="og:title" content="{{.Filename}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.PageURL}}">
+{{- if eq .Kind "image"}}
+<meta property="og:type" content="website">
+<meta property="og:image" content="{{.MediaURL}}">
+<meta property="og:image:type" content="{{.Type}}">
+<meta property="og:image:alt" content="{{.Filename}}">
+<meta name="twitter:card" content="summary_large_image">
+<meta name="twitter:image" content="{{.MediaURL}}">
+{{- else if eq .Kind "video"}}
+<meta property="og:type" content="video.other">
+<meta property="og:video" content="{{.MediaURL}}">
+<meta property="og:video:type" content="{{.Type}}">
+<meta name="twitter:card" content="summary">
+{{- else if eq .Kind "audio"}}
+<meta property="og:type" content="music.song">
+<meta property="og:audio" content="{{.MediaURL}}">
+<meta property="og:audio:type" content="{{.Type}}">
+<meta name="twitter:card" content="summary">
+{{- else}}
+<meta property="og:type" content="website">
+<meta name="twitter:card" content="summary">
+{{- end}}
+<meta name="twitter:title" content="{{.Filename}}">
+<meta name="twitter:description" content="{{.Description}}">
+<style>
+body { margin: 0; font-family: sans-serif; background: #fafafa; color: #222; }
+main { max-width: 60em; margin: 0 auto; padding: 1em; }
+h1 { font-size: 1.2em; word-break: break-all; }
+dl { display: grid; grid-template-columns: max-content auto; gap: 0.25em 1em; }
+dt { color: #666; }
+dd { margin: 0; }
+.content img, .content video { max-width: 100%; max-height: 80vh; }
+.content audio { width: 100%; }
+.content pre { background: #fff; border: 1px solid #ddd; padding: 0.5em; overflow: auto; max-height: 60vh; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Filename}}</h1>
+<div class="content">
+{{- if eq .Kind "image"}}
+<a href="{{.RawURL}}"><img src="{{.RawURL}}" alt="{{.Filename}}"></a>
+{{- else if eq .Kind "video"}}
+<video src="{{.RawURL}}" controls preload="metadata"></video>
+{{- else if eq .Kind "audio"}}
+<audio src="{{.RawURL}}" controls preload="metadata"></audio>
+{{- else if eq .Kind "text"}}
+<pre>{{.Text}}</pre>
+{{- if .Truncated}}
+<p>Only the beginning of this file is shown.</p>
+{{- end}}
+{{- end}}
+</div>
+<dl>
+<dt>Type</dt><dd>{{or .Type "unknown"}}</dd>
+<dt>Size</dt><dd>{{.Size}}</dd>
+<dt>Uploaded</dt><dd><time datetime="{{.UploadedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.UploadedAt.Format "2006-01-02 15:04 MST"}}</time></dd>
+{{- if not .ExpiresAt.IsZero}}
+<dt>Expires in</dt><dd><time id="expiry" datetime="{{.ExpiresAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.ExpiresIn}}</time></dd>
+{{- end}}
+</dl>
+<p><a href="{{.RawURL}}">Download</a>{{if .ViewURL}} · <a href="{{.ViewURL}}">View with line numbers</a>{{end}}</p>
+</main>
+<script>` + previewScript + `</script>
+</body>
+</html>
+`))
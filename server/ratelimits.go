@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/ratelimit"
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited occurs when a client exceeds one of the configured rate limits
+var ErrRateLimited = errors.New("Too many uploads, please try again later")
+
+// uploaderAccountKey is the context key of the account key of the uploader, set once
+// checkUploadCreation has identified it
+const uploaderAccountKey = "uploaderAccount"
+
+// rateLimiters holds the token buckets of all rate limits. It is owned by the
+// RunContext so that limiter state survives config reloads.
+type rateLimiters struct {
+	ipUploads      *ratelimit.Group
+	accountUploads *ratelimit.Group
+	ipBytes        *ratelimit.Group
+	accountBytes   *ratelimit.Group
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{
+		ipUploads:      ratelimit.NewGroup(),
+		accountUploads: ratelimit.NewGroup(),
+		ipBytes:        ratelimit.NewGroup(),
+		accountBytes:   ratelimit.NewGroup(),
+	}
+}
+
+// configure applies the limits of the config, keeping the state of existing buckets
+func (rl *rateLimiters) configure(cfg *Config) {
+	limits := &cfg.RateLimit
+	rl.ipUploads.SetLimits(ratelimit.Limits{
+		Rate:  rate.Limit(float64(limits.UploadsPerMinute) / 60),
+		Burst: limits.UploadBurst,
+	})
+	rl.accountUploads.SetLimits(ratelimit.Limits{
+		Rate:  rate.Limit(float64(limits.AccountUploadsPerMinute) / 60),
+		Burst: limits.AccountUploadBurst,
+	})
+	rl.ipBytes.SetLimits(ratelimit.Limits{
+		Rate:  rate.Limit(limits.BytesPerSecond.Bytes()),
+		Burst: int(limits.BytesBurst.Bytes()),
+	})
+	rl.accountBytes.SetLimits(ratelimit.Limits{
+		Rate:  rate.Limit(limits.AccountBytesPerSecond.Bytes()),
+		Burst: int(limits.AccountBytesBurst.Bytes()),
+	})
+}
+
+// accountKey identifies an EXTJWT account across issuers
+func accountKey(issuer, account string) string {
+	if account == "" {
+		return ""
+	}
+	return issuer + "\x00" + account
+}
+
+// reserveAll returns how long the client has to wait until all reservations can be
+// satisfied. If that is not immediately, the reservations are cancelled.
+func reserveAll(reservations ...*rate.Reservation) time.Duration {
+	var delay time.Duration
+	for _, r := range reservations {
+		if r != nil && r.Delay() > delay {
+			delay = r.Delay()
+		}
+	}
+
+	if delay > 0 {
+		for _, r := range reservations {
+			if r != nil {
+				r.Cancel()
+			}
+		}
+	}
+	return delay
+}
+
+func abortRateLimited(c *gin.Context, delay time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	abortWithMessage(c, http.StatusTooManyRequests, ErrRateLimited)
+}
+
+// rateLimitCreation applies the upload creation limits. Must be called after
+// processJwt so that the account is known.
+func (serv *UploadServer) rateLimitCreation(c *gin.Context) (limited bool) {
+	remoteIP, err := serv.getDirectOrForwardedRemoteIP(c.Request)
+	if err != nil {
+		return false
+	}
+	metadata := parseMeta(c.Request.Header.Get("Upload-Metadata"))
+	account := accountKey(metadata["issuer"], metadata["account"])
+	c.Set(uploaderAccountKey, account)
+
+	// single request uploads only learn the account here, so its byte debt is checked too
+	if delay := serv.rateLimiters.accountBytes.Debt(account); delay > 0 {
+		serv.log.Warn().
+			Str("event", "rate_limited").
+			Str("limit", "bytes").
+			Str("ip", remoteIP).
+			Str("account", metadata["account"]).
+			Dur("retryAfter", delay).
+			Msg("Upload data rate limited")
+		abortRateLimited(c, delay)
+		return true
+	}
+
+	delay := reserveAll(
+		serv.rateLimiters.ipUploads.Reserve(remoteIP),
+		serv.rateLimiters.accountUploads.Reserve(account),
+	)
+	if delay == 0 {
+		return false
+	}
+
+	serv.log.Warn().
+		Str("event", "rate_limited").
+		Str("limit", "uploads").
+		Str("ip", remoteIP).
+		Str("account", metadata["account"]).
+		Dur("retryAfter", delay).
+		Msg("Upload creation rate limited")
+	abortRateLimited(c, delay)
+	return true
+}
+
+// bytesRateLimiter wraps a PATCH handler. Data received is charged to the uploader's
+// buckets as it is read, slowing the request down to the limit once a bucket is in
+// debt. New requests are refused while in debt.
+func (serv *UploadServer) bytesRateLimiter(patchFile gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limiters := serv.rateLimiters
+		if !limiters.ipBytes.Enabled() && !limiters.accountBytes.Enabled() {
+			patchFile(c)
+			return
+		}
+
+		remoteIP, err := serv.getDirectOrForwardedRemoteIP(c.Request)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		// single request uploads have no ID yet, and are charged to the account once
+		// rateLimitCreation has identified it
+		account := func() string { return c.GetString(uploaderAccountKey) }
+		if id := c.Param("id"); id != "" {
+			var uploadAccount string
+			if info, err := serv.store.GetInfo(id); err == nil {
+				uploadAccount = accountKey(info.MetaData["issuer"], info.MetaData["account"])
+			}
+			account = func() string { return uploadAccount }
+		}
+
+		delay := maxDuration(limiters.ipBytes.Debt(remoteIP), limiters.accountBytes.Debt(account()))
+		if delay > 0 {
+			serv.log.Warn().
+				Str("event", "rate_limited").
+				Str("limit", "bytes").
+				Str("ip", remoteIP).
+				Dur("retryAfter", delay).
+				Msg("Upload data rate limited")
+			abortRateLimited(c, delay)
+			return
+		}
+
+		c.Request.Body = &chargingReader{
+			ReadCloser: c.Request.Body,
+			ctx:        c.Request.Context(),
+			charge: func(n int) time.Duration {
+				return maxDuration(limiters.ipBytes.Take(remoteIP, n), limiters.accountBytes.Take(account(), n))
+			},
+		}
+		patchFile(c)
+	}
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// chargingReader charges the bytes read from a request body, and waits while the
+// charge leaves a bucket in debt
+type chargingReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	charge func(n int) time.Duration
+}
+
+func (r *chargingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	if delay := r.charge(n); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+	return n, err
+}
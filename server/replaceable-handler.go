@@ -2,12 +2,45 @@ package server
 
 import (
 	"net/http"
+	"strings"
+	"sync/atomic"
 )
 
+// ReplaceableHandler forwards requests to the handler of the current server instance.
+// The handler can be replaced while requests are being served.
 type ReplaceableHandler struct {
-	Handler http.Handler
+	current atomic.Value // *mountedHandler
+}
+
+type mountedHandler struct {
+	handler  http.Handler
+	prefixes []string // route prefixes served, others respond 404
+}
+
+// Replace atomically switches to a new handler serving the given route prefixes.
+// Prefixes registered on a parent router by previous instances are no longer served.
+func (m *ReplaceableHandler) Replace(handler http.Handler, prefixes []string) {
+	m.current.Store(&mountedHandler{
+		handler:  handler,
+		prefixes: prefixes,
+	})
 }
 
 func (m *ReplaceableHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	m.Handler.ServeHTTP(w, req)
+	mounted, _ := m.current.Load().(*mountedHandler)
+	if mounted == nil || !mounted.serves(req.URL.Path) {
+		http.NotFound(w, req)
+		return
+	}
+	mounted.handler.ServeHTTP(w, req)
+}
+
+func (mounted *mountedHandler) serves(path string) bool {
+	for _, prefix := range mounted.prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/expirer"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+	"github.com/rs/zerolog"
+)
+
+// sharedResources are created with the first config and reused by the server instances
+// of later reloads, so that reloading neither reconnects to the database nor reruns its
+// migrations.
+type sharedResources struct {
+	cfg           *Config // config the database and store were created with
+	dbConn        *db.DatabaseConnection
+	store         *shardedfilestore.ShardedFileStore
+	expirerMu     sync.RWMutex // guards expirer, which update replaces
+	expirer       *expirer.Expirer
+	expirerConfig expirer.Config
+}
+
+func newSharedResources(cfg *Config, log *zerolog.Logger) *sharedResources {
+	res := &sharedResources{cfg: cfg}
+
+	res.dbConn = db.ConnectToDB(log, db.DBConfig{
+		DriverName: cfg.Database.Type,
+		DSN:        cfg.Database.Path,
+	})
+
+	res.store = shardedfilestore.New(
+		cfg.Storage.Path,
+		cfg.Storage.ShardLayers,
+		res.dbConn,
+		log,
+	)
+
+	res.expirerConfig = newExpirerConfig(cfg)
+	res.expirer = expirer.New(res.store, res.expirerConfig, log)
+
+	return res
+}
+
+// currentExpirer returns the expirer of the latest applied config
+func (res *sharedResources) currentExpirer() *expirer.Expirer {
+	res.expirerMu.RLock()
+	defer res.expirerMu.RUnlock()
+	return res.expirer
+}
+
+// keepRestartSettings gives the settings of the database and store in a reloaded config
+// their previous values, and returns those that changed as requiring a restart
+func (res *sharedResources) keepRestartSettings(cfg *Config) (needRestart []string) {
+	if cfg.Database != res.cfg.Database {
+		needRestart = append(needRestart, "Database")
+		cfg.Database = res.cfg.Database
+	}
+	if cfg.Storage.Path != res.cfg.Storage.Path {
+		needRestart = append(needRestart, "Storage.Path")
+		cfg.Storage.Path = res.cfg.Storage.Path
+	}
+	if cfg.Storage.ShardLayers != res.cfg.Storage.ShardLayers {
+		needRestart = append(needRestart, "Storage.ShardLayers")
+		cfg.Storage.ShardLayers = res.cfg.Storage.ShardLayers
+	}
+	return
+}
+
+// update applies a reloaded config once its server instance runs. The expirer is
+// recreated when its settings changed.
+func (res *sharedResources) update(cfg *Config, log *zerolog.Logger) {
+	expirerConfig := newExpirerConfig(cfg)
+	if reflect.DeepEqual(expirerConfig, res.expirerConfig) {
+		return
+	}
+
+	res.expirerMu.Lock()
+	defer res.expirerMu.Unlock()
+	res.expirer.Stop()
+	res.expirerConfig = expirerConfig
+	res.expirer = expirer.New(res.store, expirerConfig, log)
+	log.Info().
+		Str("event", "config_reload").
+		Msg("Restarted expirer with the new settings")
+}
+
+// close finalizes in-flight uploads, then stops the expirer and closes the database
+func (res *sharedResources) close() {
+	// the database is needed to finalize completed uploads, even past the deadline
+	res.store.Drain()
+
+	// stop running FileStore GC cycles
+	res.currentExpirer().Stop()
+
+	// close db connections
+	res.dbConn.DB.Close()
+}
+
+// changedSections lists the top level config sections that differ between two configs
+func changedSections(previous, current *Config) (sections []string) {
+	prev := reflect.ValueOf(previous).Elem()
+	cur := reflect.ValueOf(current).Elem()
+
+	for i := 0; i < cur.NumField(); i++ {
+		if cur.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		if !reflect.DeepEqual(prev.Field(i).Interface(), cur.Field(i).Interface()) {
+			sections = append(sections, cur.Type().Field(i).Name)
+		}
+	}
+	return
+}
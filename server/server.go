@@ -1,7 +1,8 @@
 package server
 
 import (
-	"fmt"
+	"context"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -9,6 +10,7 @@ import (
 	"sync"
 	"syscall"
 
+	"github.com/kiwiirc/plugin-fileuploader/logging"
 	"github.com/rs/zerolog"
 	globalZerolog "github.com/rs/zerolog/log"
 )
@@ -18,35 +20,104 @@ type RunContext struct {
 
 	parentRouter    *http.ServeMux
 	configPath      string
+	overrides       Overrides
+	startErr        error
+	handleSignals   bool
+	logFunc         LogFunc
+	discoverIssuers IssuerDiscovery
+	announcer       Announcer
 	reloadSignals   chan os.Signal
 	shutdownSignals chan os.Signal
 	log             *zerolog.Logger
+	rateLimiters    *rateLimiters      // shared by successive server instances
+	bandwidth       *bandwidthLimiters // shared by successive server instances
 }
 
 func NewRunContext(parentRouter *http.ServeMux, configPath string) *RunContext {
 	runCtx := &RunContext{
 		parentRouter:    parentRouter,
 		configPath:      configPath,
+		handleSignals:   true,
 		log:             &globalZerolog.Logger, // default global zerolog
 		reloadSignals:   make(chan os.Signal, 1),
 		shutdownSignals: make(chan os.Signal, 1),
+		rateLimiters:    newRateLimiters(),
+		bandwidth:       newBandwidthLimiters(),
 	}
 	runCtx.ShutdownPromise.Add(1)
 	return runCtx
 }
 
-func (runCtx *RunContext) Run() {
+// SetOverrides sets config values given on the command line, applied on each load
+func (runCtx *RunContext) SetOverrides(overrides Overrides) {
+	runCtx.overrides = overrides
+}
+
+// LogFunc receives log events formatted for humans, along with their level
+type LogFunc func(level zerolog.Level, line string)
+
+// SetSignalHandling chooses whether SIGHUP, SIGINT and SIGTERM reload and stop the server.
+// When disabled, the host application calls Reload and Shutdown instead.
+func (runCtx *RunContext) SetSignalHandling(enabled bool) {
+	runCtx.handleSignals = enabled
+}
+
+// SetLogFunc additionally passes log events to fn, such as the logger of a host application
+func (runCtx *RunContext) SetLogFunc(fn LogFunc) {
+	runCtx.logFunc = fn
+}
+
+// IssuerDiscovery returns the HMAC secrets of EXTJWT issuers known to a host application
+type IssuerDiscovery func() map[string]string
+
+// SetIssuerDiscovery adds the issuers returned by fn to each loaded config. Issuers in
+// JwtSecretsByIssuer or JwtIssuers take precedence.
+func (runCtx *RunContext) SetIssuerDiscovery(fn IssuerDiscovery) {
+	runCtx.discoverIssuers = fn
+}
+
+// SetAnnouncer has fn send the announcements of finished uploads configured in the
+// Announce section
+func (runCtx *RunContext) SetAnnouncer(fn Announcer) {
+	runCtx.announcer = fn
+}
+
+// Reload reloads the config, like SIGHUP. Reloads requested while one is pending are merged.
+func (runCtx *RunContext) Reload() {
+	select {
+	case runCtx.reloadSignals <- syscall.SIGHUP:
+	default:
+	}
+}
+
+// Shutdown stops the server gracefully, like SIGTERM. Run returns once it has stopped.
+func (runCtx *RunContext) Shutdown() {
+	select {
+	case runCtx.shutdownSignals <- syscall.SIGTERM:
+	default:
+	}
+}
+
+// Run serves until a shutdown signal is received. Returns an error when the server could
+// not be started.
+func (runCtx *RunContext) Run() error {
 	// signal handler
-	go runCtx.signalHandler()
+	if runCtx.handleSignals {
+		go runCtx.signalHandler()
+	}
 
 	// server run loop
 	go runCtx.runLoop()
 
 	runCtx.ShutdownPromise.Wait()
+	if runCtx.startErr != nil {
+		return runCtx.startErr
+	}
 
 	runCtx.log.Info().
 		Str("event", "shutdown").
 		Msg("Shutdown complete")
+	return nil
 }
 
 func (runCtx *RunContext) signalHandler() {
@@ -68,119 +139,243 @@ func (runCtx *RunContext) signalHandler() {
 	}
 }
 
-func (runCtx *RunContext) runLoop() {
-	var replaceableHandler *ReplaceableHandler
-	if runCtx.parentRouter != nil {
-		replaceableHandler = &ReplaceableHandler{}
+// loadConfig loads and validates the config, then switches to its loggers
+func (runCtx *RunContext) loadConfig() (*Config, error) {
+	cfg, err := LoadConfig(runCtx.configPath, runCtx.overrides)
+	if err != nil {
+		return nil, err
 	}
-	registeredPrefixes := make(map[string]struct{}, 0)
 
-	for {
-		// new server instance
-		serv := UploadServer{}
-		cfg := NewConfig()
+	var extra []io.Writer
+	if runCtx.logFunc != nil {
+		extra = append(extra, logging.FuncLevelWriter{Func: runCtx.logFunc})
+	}
+	multiLogger, err := createMultiLogger(cfg.Loggers, extra...)
+	if err != nil {
+		return nil, err
+	}
 
-		// refresh config
-		md, err := cfg.Load(runCtx.log, runCtx.configPath)
-		if err != nil {
-			runCtx.log.Error().Err(err).Msg("Failed to load config")
-			return
-		}
+	runCtx.log = multiLogger
+	runCtx.log.Info().Str("path", runCtx.configPath).Msg("Loaded config file")
+	cfg.DoPostLoadLogging(runCtx.log, runCtx.configPath)
+
+	if runCtx.discoverIssuers != nil {
+		added, skipped := cfg.addDiscoveredIssuers(runCtx.discoverIssuers())
+		runCtx.log.Info().
+			Str("event", "issuer_discovery").
+			Strs("issuers", added).
+			Strs("configured", skipped).
+			Msg("Discovered EXTJWT issuers")
+	}
+	return cfg, nil
+}
+
+// logConfigError logs each problem of an invalid config
+func (runCtx *RunContext) logConfigError(err error, msg string) {
+	event := runCtx.log.Error().Str("path", runCtx.configPath)
+	if errs, ok := err.(ConfigErrors); ok {
+		event = event.Strs("errors", errs.Strings())
+	} else {
+		event = event.Err(err)
+	}
+	event.Msg(msg)
+}
 
-		serv.cfg = *cfg
+func (runCtx *RunContext) runLoop() {
+	replaceableHandler := &ReplaceableHandler{}
+	registeredPrefixes := make(map[string]struct{}, 0)
 
-		multiLogger, err := createMultiLogger(serv.cfg.Loggers)
-		if err != nil {
-			runCtx.log.Err(err).Msg("Failed to create MultiLogger")
+	// in standalone mode, listeners are kept open across reloads
+	var standalone *standaloneServer
+	serveErrors := make(chan error, 2)
+
+	// the database, store and expirer are kept across reloads
+	var resources *sharedResources
+	var currentCfg *Config
+
+	// start runs a server instance with the config, which takes over new requests
+	start := func(cfg *Config) (*UploadServer, error) {
+		var needRestart []string
+		if resources != nil {
+			runCtx.log.Info().
+				Str("event", "config_reload").
+				Strs("sections", changedSections(currentCfg, cfg)).
+				Msg("Applying changed config sections")
+			needRestart = resources.keepRestartSettings(cfg)
 		}
 
-		runCtx.log = multiLogger
-		serv.log = runCtx.log
-		runCtx.log.Info().Str("path", runCtx.configPath).Msg("Loaded config file")
-		cfg.DoPostLoadLogging(runCtx.log, runCtx.configPath, md)
+		serv := &UploadServer{
+			cfg:          *cfg,
+			log:          runCtx.log,
+			resources:    resources,
+			rateLimiters: runCtx.rateLimiters,
+			bandwidth:    runCtx.bandwidth,
+			announcer:    runCtx.announcer,
+		}
+		if err := serv.Run(replaceableHandler); err != nil {
+			return nil, err
+		}
+		if resources != nil {
+			resources.update(cfg, runCtx.log)
+		}
+		resources = serv.resources
+		currentCfg = cfg
+		runCtx.rateLimiters.configure(cfg)
+		runCtx.bandwidth.configure(cfg)
 
-		// register handler on parentRouter if any, when prefix has not been previously registered
 		if runCtx.parentRouter != nil {
-			routePrefix, err := routePrefixFromBasePath(serv.cfg.Server.BasePath)
-			if err != nil {
-				panic(err)
-			}
-			if _, ok := registeredPrefixes[routePrefix]; !ok { // this prefix not yet registered
-				registeredPrefixes[routePrefix] = struct{}{}
-				runCtx.parentRouter.Handle(routePrefix, replaceableHandler)
-				if !strings.HasSuffix(routePrefix, "/") {
-					runCtx.parentRouter.Handle(routePrefix+"/", replaceableHandler)
+			// register handler on parentRouter, when prefix has not been previously
+			// registered. Prefixes dropped from the config remain registered, but the
+			// ReplaceableHandler responds 404 to them.
+			for _, routePrefix := range serv.routePrefixes() {
+				if _, ok := registeredPrefixes[routePrefix]; !ok { // this prefix not yet registered
+					registeredPrefixes[routePrefix] = struct{}{}
+					runCtx.parentRouter.Handle(routePrefix, replaceableHandler)
+					if !strings.HasSuffix(routePrefix, "/") {
+						runCtx.parentRouter.Handle(routePrefix+"/", replaceableHandler)
+					}
+					runCtx.log.Info().
+						Str("event", "startup").
+						Str("routePrefix", routePrefix).
+						Msg("Fileuploader handler mounted on parent router")
 				}
-				runCtx.log.Info().
-					Str("event", "startup").
-					Str("routePrefix", routePrefix).
-					Msg("Fileuploader handler mounted on parent router")
 			}
+		} else {
+			needRestart = append(needRestart, runCtx.serveStandalone(&standalone, &serv.cfg, replaceableHandler, serveErrors)...)
 		}
 
-		errChan := make(chan error)
-
-		// run server until .Shutdown() called or other error occurs
-		go func() {
-			err := serv.Run(replaceableHandler)
-			if err != nil {
-				errChan <- err
-			}
-		}()
+		if len(needRestart) > 0 {
+			runCtx.log.Warn().
+				Str("event", "config_reload").
+				Strs("settings", needRestart).
+				Msg("Changed settings only take effect after a restart")
+		}
+		return serv, nil
+	}
 
-		// wait for startup to complete
-		<-serv.GetStartedChan()
-		if runCtx.parentRouter == nil {
-			runCtx.log.Info().
-				Str("event", "startup").
-				Str("address", serv.cfg.Server.ListenAddress).
-				Msg("Server listening")
+	cfg, err := runCtx.loadConfig()
+	if err == nil {
+		var serv *UploadServer
+		serv, err = start(cfg)
+		if err == nil {
+			runCtx.serve(serv, start, &standalone, serveErrors)
+			resources.close()
+			runCtx.ShutdownPromise.Done()
+			return
 		}
+	}
 
-		// wait for error or reload request
-		shouldRestart := func() bool {
-			select {
+	runCtx.logConfigError(err, "Invalid config, not starting")
+	runCtx.startErr = err
+	runCtx.ShutdownPromise.Done()
+}
 
-			case err := <-errChan:
+// serve handles reload requests until a shutdown signal is received. Reloads with an
+// invalid config keep the current server instance running. Returns once previous
+// instances have drained too, so that the shared resources can be closed.
+func (runCtx *RunContext) serve(serv *UploadServer, start func(*Config) (*UploadServer, error), standalone **standaloneServer, serveErrors <-chan error) {
+	var draining sync.WaitGroup
+	for {
+		select {
 
-				fmt.Printf("errChan: %#v\n", err)
-				// quit if unexpected error occurred
-				if err != http.ErrServerClosed {
-					runCtx.log.Fatal().
-						Err(err).
-						Msg("Error running upload server")
-				}
+		case err := <-serveErrors:
+			runCtx.log.Fatal().
+				Err(err).
+				Msg("Error serving HTTP")
 
-				// server closed by request, exit loop to allow it to restart
-				return true
+		case <-runCtx.reloadSignals:
+			runCtx.log.Info().
+				Str("event", "config_reload").
+				Msg("Reloading server config")
 
-			case <-runCtx.reloadSignals:
-				// Run in separate goroutine so we don't wait for .Shutdown()
-				// to return before starting the new server.
-				// This allows us to handle outstanding requests using the old
-				// server instance while we've already replaced it as the listener
-				// for new connections.
-				go func() {
-					runCtx.log.Info().
-						Str("event", "config_reload").
-						Msg("Reloading server config")
-					serv.Shutdown()
-				}()
-				return true
+			cfg, err := runCtx.loadConfig()
+			if err != nil {
+				runCtx.logConfigError(err, "Invalid config, keeping the current one")
+				continue
+			}
+			next, err := start(cfg)
+			if err != nil {
+				runCtx.logConfigError(err, "Failed to apply config, keeping the current one")
+				continue
+			}
 
-			case <-runCtx.shutdownSignals:
+			// The previous instance handles its outstanding requests in the background,
+			// new requests are already served by the new instance.
+			previous := serv
+			serv = next
+			draining.Add(1)
+			go func() {
+				defer draining.Done()
 				runCtx.log.Info().
-					Str("event", "shutdown_started").
-					Msg("Shutdown initiated. Handling existing requests")
-				serv.Shutdown()
-				runCtx.ShutdownPromise.Done()
-				return false
-
+					Str("event", "config_reload").
+					Msg("Draining previous server instance")
+				ctx, cancel := context.WithTimeout(context.Background(), previous.cfg.Server.ShutdownTimeout.Duration)
+				defer cancel()
+				previous.Shutdown(ctx)
+			}()
+
+		case <-runCtx.shutdownSignals:
+			runCtx.log.Info().
+				Str("event", "shutdown_started").
+				Msg("Shutdown initiated. Handling existing requests")
+			ctx, cancel := context.WithTimeout(context.Background(), serv.cfg.Server.ShutdownTimeout.Duration)
+			defer cancel()
+			if *standalone != nil {
+				(*standalone).shutdown(ctx)
 			}
-		}()
-
-		if !shouldRestart {
+			serv.Shutdown(ctx)
+			draining.Wait()
 			return
+
+		}
+	}
+}
+
+// serveStandalone starts listening with the first config, and applies the listener
+// settings of reloaded configs. Returns the changed settings that require a restart.
+func (runCtx *RunContext) serveStandalone(standalone **standaloneServer, cfg *Config, handler http.Handler, serveErrors chan<- error) []string {
+	if *standalone == nil {
+		ss, err := startStandaloneServer(cfg, handler, serveErrors)
+		if err != nil {
+			runCtx.log.Fatal().
+				Err(err).
+				Str("address", cfg.Server.ListenAddress).
+				Msg("Failed to listen")
+		}
+		*standalone = ss
+
+		runCtx.log.Info().
+			Str("event", "startup").
+			Str("address", cfg.Server.ListenAddress).
+			Bool("tls", ss.tls).
+			Str("redirectAddress", ss.redirectAddr).
+			Msg("Server listening")
+		return nil
+	}
+
+	needRestart, err := (*standalone).reload(cfg)
+	if err != nil {
+		runCtx.log.Error().
+			Err(err).
+			Msg("Failed to reload TLS certificate, keeping the previous one")
+	}
+	return needRestart
+}
+
+// servedRoutePrefixes returns the URL path prefixes of the upload and admin routes
+func servedRoutePrefixes(cfg *Config) ([]string, error) {
+	basePaths := []string{cfg.Server.BasePath}
+	if len(cfg.Admin.Tokens) > 0 {
+		basePaths = append(basePaths, cfg.Admin.BasePath)
+	}
+
+	var prefixes []string
+	for _, basePath := range basePaths {
+		routePrefix, err := routePrefixFromBasePath(basePath)
+		if err != nil {
+			return nil, err
 		}
+		prefixes = append(prefixes, routePrefix)
 	}
+	return prefixes, nil
 }
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+	"github.com/tus/tusd"
+)
+
+// simpleUploadPath is the route of uploads made in a single request, relative to BasePath
+const simpleUploadPath = "simple"
+
+// multipartMemory is how much of a multipart upload is held in memory, the rest is
+// buffered in temporary files
+const multipartMemory = 10 << 20
+
+// multipartOverhead allows for the boundaries and other fields of multipart uploads
+const multipartOverhead = 1 << 20
+
+// ErrFormTooLarge occurs when the form fields of a multipart upload exceed multipartOverhead
+var ErrFormTooLarge = errors.New("Form fields are too large")
+
+// ErrLengthRequired occurs when a PUT upload has no Content-Length
+var ErrLengthRequired = errors.New("Content-Length is required")
+
+// ErrFileFieldMissing occurs when a multipart upload has no "file" field
+var ErrFileFieldMissing = errors.New(`The "file" form field is missing`)
+
+// ErrIncompleteUpload occurs when a single request upload ends before all data is received
+var ErrIncompleteUpload = errors.New("Upload is incomplete")
+
+// simpleUploadFields are the metadata fields clients can set with form fields or query
+// parameters. The EXTJWT may also be given as "Authorization: Bearer <token>".
+var simpleUploadFields = []string{"extjwt", "type", "channelonly", "announce"}
+
+type singleRequestUploadResponse struct {
+	ID   string `json:"id"`
+	URL  string `json:"url"`
+	View string `json:"view,omitempty"` // page showing text uploads
+}
+
+// simpleUpload handles uploads made in a single request, as a multipart form with a
+// "file" field or as the body of a PUT request. They are turned into tus creation
+// requests carrying all of the data, so that they take the same path as other uploads.
+func (serv *UploadServer) simpleUpload(handler *tusd.UnroutedHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := c.Request
+		if req.Method != http.MethodPut {
+			serv.multipartUpload(c, handler)
+			return
+		}
+
+		if req.ContentLength < 0 {
+			abortWithMessage(c, http.StatusLengthRequired, ErrLengthRequired)
+			return
+		}
+		metadata := map[string]string{
+			"filename": c.Param("name"),
+			"type":     req.Header.Get("Content-Type"),
+		}
+		addClientFields(c, metadata)
+		setCreationHeaders(req, metadata, req.ContentLength)
+		if !serv.checkUploadCreation(c) {
+			return
+		}
+		serv.createSingleRequestUpload(c, handler, metadata)
+	}
+}
+
+// multipartUpload handles simple uploads made as a multipart form. The uploader is
+// checked once the fields and the headers of the file are read, before receiving the
+// file. The file is then received into a temporary file up to the size limit of the
+// uploader, as the upload can only be created once its length is known.
+func (serv *UploadServer) multipartUpload(c *gin.Context, handler *tusd.UnroutedHandler) {
+	req := c.Request
+	part, status, err := serv.openMultipartFile(c)
+	if err != nil {
+		abortWithMessage(c, status, err)
+		return
+	}
+
+	metadata := map[string]string{
+		"filename": part.FileName(),
+		"type":     part.Header.Get("Content-Type"),
+	}
+	addClientFields(c, metadata)
+	// only uploaders already over their quota are rejected before the size is known
+	setCreationHeaders(req, metadata, 0)
+	if !serv.checkUploadCreation(c) {
+		return
+	}
+
+	// processJwt has added the identity of the uploader to the metadata
+	metadata = parseMeta(req.Header.Get("Upload-Metadata"))
+	var file io.Reader = part
+	limits := serv.policies.Lookup(metadata["issuer"], metadata["account"], shardedfilestore.MimeType(metadata))
+	if limits.MaximumUploadSize > 0 {
+		file = io.LimitReader(part, limits.MaximumUploadSize+1)
+	}
+	spooled, size, err := spool(ioutil.NopCloser(file))
+	if err != nil {
+		abortWithMessage(c, http.StatusBadRequest, err)
+		return
+	}
+	defer os.Remove(spooled.Name())
+	defer spooled.Close()
+
+	setCreationHeaders(req, metadata, size)
+	if !serv.checkPolicy(c) {
+		return
+	}
+	req.Body = spooled
+	serv.createSingleRequestUpload(c, handler, metadata)
+}
+
+// addClientFields adds the metadata fields given as form fields or query parameters
+func addClientFields(c *gin.Context, metadata map[string]string) {
+	for _, field := range simpleUploadFields {
+		if value, ok := simpleUploadField(c, field); ok {
+			metadata[field] = value
+		}
+	}
+	if metadata["extjwt"] == "" {
+		metadata["extjwt"] = requestToken(c)
+	}
+
+	// channelonly is only checked for presence, but empty values do not survive the
+	// Upload-Metadata header
+	for field, value := range metadata {
+		if value == "" {
+			delete(metadata, field)
+		}
+	}
+	if _, ok := simpleUploadField(c, "channelonly"); ok {
+		metadata["channelonly"] = "1"
+	}
+}
+
+// setCreationHeaders turns a single request upload into a tus creation request that
+// carries all of the data
+func setCreationHeaders(req *http.Request, metadata map[string]string, size int64) {
+	// tusd serves downloads with the type in the filetype field
+	if metadata["type"] != "" {
+		metadata["filetype"] = metadata["type"]
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Metadata", serializeMeta(metadata))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	req.Header.Del("Upload-Defer-Length")
+	req.Header.Del("Upload-Concat")
+	req.ContentLength = size
+}
+
+// createSingleRequestUpload has the tus handler create the upload and write the request
+// body to it, then responds with the ID and URL of the upload. Must be called after
+// checkUploadCreation.
+func (serv *UploadServer) createSingleRequestUpload(c *gin.Context, handler *tusd.UnroutedHandler, metadata map[string]string) {
+	rec := &responseRecorder{header: make(http.Header)}
+	handler.PostFile(rec, c.Request)
+
+	location := rec.header.Get("Location")
+	id := path.Base(location)
+	complete := rec.header.Get("Upload-Offset") == c.Request.Header.Get("Upload-Length")
+
+	if rec.status != http.StatusCreated || !complete {
+		if location != "" {
+			// the data of a single request upload cannot be resumed
+			if err := serv.store.Terminate(id); err != nil {
+				serv.log.Error().
+					Err(err).
+					Str("id", id).
+					Msg("Failed to remove incomplete upload")
+			}
+		}
+		if rec.status == http.StatusCreated {
+			abortWithMessage(c, http.StatusBadRequest, ErrIncompleteUpload)
+			return
+		}
+		c.Data(rec.status, rec.header.Get("Content-Type"), rec.body.Bytes())
+		c.Abort()
+		return
+	}
+
+	link := location
+	if filename := metadata["filename"]; filename != "" {
+		link += "/" + url.PathEscape(filename)
+	}
+	response := singleRequestUploadResponse{ID: id, URL: link}
+	if isText(metadata) {
+		response.View = location + "/" + pasteViewName
+	}
+	c.Header("Location", location)
+	c.JSON(http.StatusCreated, response)
+}
+
+// openMultipartFile reads the form fields of a multipart upload into PostForm, up to
+// the "file" field, which is returned unread. Fields following the file are ignored.
+func (serv *UploadServer) openMultipartFile(c *gin.Context) (*multipart.Part, int, error) {
+	req := c.Request
+	if largest := serv.policies.LargestUploadSize(); largest > 0 {
+		if req.ContentLength > largest+multipartOverhead {
+			return nil, http.StatusRequestEntityTooLarge, ErrUploadTooLarge
+		}
+		req.Body = http.MaxBytesReader(c.Writer, req.Body, largest+multipartOverhead)
+	}
+
+	reader, err := req.MultipartReader()
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	req.PostForm = make(url.Values)
+	remaining := int64(multipartOverhead)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, http.StatusBadRequest, ErrFileFieldMissing
+		}
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if part.FormName() == "file" {
+			return part, 0, nil
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, remaining+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if remaining -= int64(len(value)); remaining < 0 {
+			return nil, http.StatusRequestEntityTooLarge, ErrFormTooLarge
+		}
+		req.PostForm.Add(part.FormName(), string(value))
+	}
+}
+
+// simpleUploadField returns the value of a parsed form field, or else the query parameter
+func simpleUploadField(c *gin.Context, name string) (string, bool) {
+	if values := c.Request.PostForm[name]; len(values) > 0 {
+		return values[0], true
+	}
+	return c.GetQuery(name)
+}
+
+// responseRecorder captures the response of the tus handler, which is translated for
+// single request uploads
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(p)
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"io"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/throttle"
+	"golang.org/x/time/rate"
+)
+
+// bandwidthLimiters holds the global bandwidth caps. It is owned by the RunContext so
+// that the caps are shared with requests still served by a previous server instance.
+type bandwidthLimiters struct {
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+func newBandwidthLimiters() *bandwidthLimiters {
+	return &bandwidthLimiters{
+		upload:   rate.NewLimiter(rate.Inf, 0),
+		download: rate.NewLimiter(rate.Inf, 0),
+	}
+}
+
+func (bl *bandwidthLimiters) configure(cfg *Config) {
+	throttle.SetLimit(bl.upload, int64(cfg.Throttle.UploadGlobal.Bytes()))
+	throttle.SetLimit(bl.download, int64(cfg.Throttle.DownloadGlobal.Bytes()))
+}
+
+// perConnectionCap returns the identified cap for identified clients, when configured
+func perConnectionCap(identified bool, perConnection, identifiedPerConnection uint64) int64 {
+	if identified && identifiedPerConnection > 0 {
+		return int64(identifiedPerConnection)
+	}
+	return int64(perConnection)
+}
+
+// uploadThrottle wraps a PATCH handler and caps the bandwidth used to receive the data
+func (serv *UploadServer) uploadThrottle(patchFile gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caps := &serv.cfg.Throttle
+
+		identified := false
+		if id := c.Param("id"); id != "" && caps.IdentifiedUploadPerConnection > 0 {
+			if info, err := serv.store.GetInfo(id); err == nil {
+				identified = info.MetaData["account"] != ""
+			}
+		}
+
+		connectionLimiter := throttle.NewLimiter(perConnectionCap(
+			identified,
+			caps.UploadPerConnection.Bytes(),
+			caps.IdentifiedUploadPerConnection.Bytes(),
+		))
+
+		body := c.Request.Body
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{
+			throttle.NewReader(c.Request.Context(), body, serv.bandwidth.upload, connectionLimiter),
+			body,
+		}
+
+		patchFile(c)
+	}
+}
+
+// downloadThrottle wraps a GET handler and caps the bandwidth used to send the file
+func (serv *UploadServer) downloadThrottle(getFile gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caps := &serv.cfg.Throttle
+
+		identified := false
+		if caps.IdentifiedDownloadPerConnection > 0 {
+			identified = serv.presentsAccount(requestToken(c))
+		}
+
+		connectionLimiter := throttle.NewLimiter(perConnectionCap(
+			identified,
+			caps.DownloadPerConnection.Bytes(),
+			caps.IdentifiedDownloadPerConnection.Bytes(),
+		))
+
+		c.Writer = &throttledResponseWriter{
+			ResponseWriter: c.Writer,
+			throttled:      throttle.NewWriter(c.Request.Context(), c.Writer, serv.bandwidth.download, connectionLimiter),
+		}
+
+		getFile(c)
+	}
+}
+
+// presentsAccount reports whether the token is a valid EXTJWT with an account
+func (serv *UploadServer) presentsAccount(tokenString string) bool {
+	if tokenString == "" {
+		return false
+	}
+	token, err := serv.jwtVerifier.Parse(tokenString)
+	if err != nil || !token.Valid {
+		return false
+	}
+	account, _ := token.Claims.(jwt.MapClaims)["account"].(string)
+	return account != ""
+}
+
+type throttledResponseWriter struct {
+	gin.ResponseWriter
+	throttled io.Writer
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	return w.throttled.Write(p)
+}
@@ -10,11 +10,15 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/kiwiirc/plugin-fileuploader/db"
 	"github.com/kiwiirc/plugin-fileuploader/events"
+	"github.com/kiwiirc/plugin-fileuploader/expirer"
+	"github.com/kiwiirc/plugin-fileuploader/extjwt"
 	"github.com/kiwiirc/plugin-fileuploader/logging"
 	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
 	"github.com/tus/tusd"
@@ -59,7 +63,8 @@ func (serv *UploadServer) registerTusHandlers(r *gin.Engine, store *shardedfiles
 	composer := tusd.NewStoreComposer()
 	store.UseIn(composer)
 
-	maximumUploadSize := serv.cfg.Storage.MaximumUploadSize
+	// the limit of the matching policy is enforced by postFile
+	maximumUploadSize := datasize.ByteSize(serv.policies.LargestUploadSize())
 	serv.log.Debug().Str("size", maximumUploadSize.String()).Msg("Using upload limit")
 
 	config := tusd.Config{
@@ -92,18 +97,34 @@ func (serv *UploadServer) registerTusHandlers(r *gin.Engine, store *shardedfiles
 	// attach uploader IP recorder
 	go serv.ipRecorder(serv.tusEventBroadcaster)
 
+	// attach channel announcements
+	go serv.announceFinished(serv.tusEventBroadcaster)
+
 	noopHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 
 	// For unknown reasons, this middleware must be mounted on the top level router.
 	// When attached to the RouterGroup, it does not get called for some requests.
 	tusdMiddleware := gin.WrapH(handler.Middleware(noopHandler))
-	r.Use(tusdMiddleware)
+	r.Use(func(c *gin.Context) {
+		// the tusd middleware rejects requests lacking a Tus-Resumable header
+		if serv.isTusRequest(c.Request) {
+			tusdMiddleware(c)
+		}
+	})
 	r.Use(customizedCors(serv.cfg.Server.CorsOrigins))
 
 	rg := r.Group(routePrefix)
-	rg.POST("", serv.postFile(handler))
-	rg.HEAD(":id", gin.WrapF(handler.HeadFile))
-	rg.PATCH(":id", gin.WrapF(handler.PatchFile))
+	rg.POST("", serv.banGuard(serv.postFile(handler)))
+	simpleUpload := serv.banGuard(serv.bytesRateLimiter(serv.uploadThrottle(serv.simpleUpload(handler))))
+	rg.POST(simpleUploadPath, simpleUpload)
+	rg.PUT(simpleUploadPath+"/:name", simpleUpload)
+	rg.POST(pastePath, serv.banGuard(serv.bytesRateLimiter(serv.uploadThrottle(serv.pasteUpload(handler)))))
+	if serv.fetcher != nil {
+		rg.POST(fetchUploadPath, serv.banGuard(serv.fetchUpload(serv.bytesRateLimiter(serv.uploadThrottle(serv.storeFetched(handler))))))
+	}
+	// the metadata returned by HEAD is guarded like the content of the upload
+	rg.HEAD(":id", serv.accessGuards(gin.WrapF(handler.HeadFile)))
+	rg.PATCH(":id", serv.banGuard(serv.bytesRateLimiter(serv.uploadThrottle(gin.WrapF(handler.PatchFile)))))
 
 	// Only attach the DELETE handler if the Terminate() method is provided
 	if config.StoreComposer.UsesTerminater {
@@ -112,9 +133,27 @@ func (serv *UploadServer) registerTusHandlers(r *gin.Engine, store *shardedfiles
 
 	// GET handler requires the GetReader() method
 	if config.StoreComposer.UsesGetReader {
-		getFile := gin.WrapF(handler.GetFile)
-		rg.GET(":id", getFile)
+		getFile := serv.downloadGuards(gin.WrapF(handler.GetFile))
+		viewPaste := serv.downloadGuards(serv.viewPaste)
+		previewUpload := serv.accessGuards(serv.previewUpload)
+		rg.GET(":id", func(c *gin.Context) {
+			if _, ok := c.GetQuery("preview"); ok {
+				previewUpload(c)
+				return
+			}
+			getFile(c)
+		})
 		rg.GET(":id/:filename", func(c *gin.Context) {
+			if _, ok := c.GetQuery("preview"); ok {
+				previewUpload(c)
+				return
+			}
+			// gin cannot route a static segment next to the :filename wildcard
+			if c.Param("filename") == pasteViewName && !serv.uploadNamed(c.Param("id"), pasteViewName) {
+				viewPaste(c)
+				return
+			}
+
 			// rewrite request path to ":id" route pattern
 			c.Request.URL.Path = path.Join(routePrefix, url.PathEscape(c.Param("id")))
 
@@ -126,51 +165,135 @@ func (serv *UploadServer) registerTusHandlers(r *gin.Engine, store *shardedfiles
 	return nil
 }
 
-func isFatalJwtError(err error) (fatal bool) {
-	fatal = true
+// downloadGuards wraps a handler serving the content of an upload with the checks and
+// bookkeeping of downloads
+func (serv *UploadServer) downloadGuards(next gin.HandlerFunc) gin.HandlerFunc {
+	return serv.accessGuards(serv.downloadRecorder(serv.downloadThrottle(next)))
+}
+
+// accessGuards wraps a handler showing an upload with the access checks of downloads
+func (serv *UploadServer) accessGuards(next gin.HandlerFunc) gin.HandlerFunc {
+	guarded := serv.heldDownloadGuard(serv.channelAccessGuard(next))
+	if serv.cfg.Bans.CheckDownloads {
+		guarded = serv.banGuard(guarded)
+	}
+	return guarded
+}
 
+// isTusRequest reports whether the request is for a tus protocol route rather than
+// one of the other APIs served by the same router
+func (serv *UploadServer) isTusRequest(req *http.Request) bool {
+	if routePrefix, err := routePrefixFromBasePath(serv.cfg.Server.BasePath); err == nil {
+		for _, route := range []string{simpleUploadPath, fetchUploadPath, pastePath} {
+			prefix := path.Join(routePrefix, route)
+			if req.URL.Path == prefix || strings.HasPrefix(req.URL.Path, prefix+"/") {
+				return false
+			}
+		}
+	}
+	if serv.adminEnabled() {
+		adminPrefix, err := routePrefixFromBasePath(serv.cfg.Admin.BasePath)
+		if err == nil && strings.HasPrefix(req.URL.Path, adminPrefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func isFatalJwtError(err error) (fatal bool) {
 	// jwt.ValidationError<UnknownIssuerError> => non-fatal
+	return asUnknownIssuerError(err) == nil
+}
+
+// asUnknownIssuerError returns the UnknownIssuerError wrapped by a token validation error, if any
+func asUnknownIssuerError(err error) *UnknownIssuerError {
 	if jwtValidationErr, ok := err.(*jwt.ValidationError); ok {
-		if _, ok := jwtValidationErr.Inner.(*UnknownIssuerError); ok {
-			fatal = false
-			return
+		if unknownIssuerErr, ok := jwtValidationErr.Inner.(*UnknownIssuerError); ok {
+			return unknownIssuerErr
 		}
 	}
-
-	return
+	return nil
 }
 
 func (serv *UploadServer) postFile(handler *tusd.UnroutedHandler) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		err := serv.addRemoteIPToMetadata(c.Request)
-		if err != nil {
-			if addrErr, ok := err.(*net.AddrError); ok {
-				c.AbortWithError(http.StatusInternalServerError, addrErr).SetType(gin.ErrorTypePrivate)
-			} else {
-				c.AbortWithError(http.StatusNotAcceptable, err)
-			}
-			return
+		if serv.checkUploadCreation(c) {
+			handler.PostFile(c.Writer, c.Request)
 		}
+	}
+}
 
-		err = serv.processJwt(c.Request)
+// checkUploadCreation adds the RemoteIP and EXTJWT metadata to a creation request, then
+// applies the EXTJWT mode, rate limits and policies. Returns false when the request has
+// been aborted.
+func (serv *UploadServer) checkUploadCreation(c *gin.Context) bool {
+	err := serv.addRemoteIPToMetadata(c.Request)
+	if err != nil {
+		if addrErr, ok := err.(*net.AddrError); ok {
+			c.AbortWithError(http.StatusInternalServerError, addrErr).SetType(gin.ErrorTypePrivate)
+		} else {
+			c.AbortWithError(http.StatusNotAcceptable, err)
+		}
+		return false
+	}
 
-		if err != nil {
-			if isFatalJwtError(err) {
-				if jwtValidationErr, ok := err.(*jwt.ValidationError); ok && jwtValidationErr.Inner == jwt.ErrSignatureInvalid {
-					c.Error(jwtValidationErr).SetType(gin.ErrorTypePublic)
-					c.AbortWithStatusJSON(http.StatusUnauthorized, fmt.Sprintf("Failed to process EXTJWT: %s. Configured secret may be incorrect.", jwtValidationErr))
-					return
-				}
-				c.AbortWithError(http.StatusBadRequest, err).SetType(gin.ErrorTypePublic)
-				return
+	err = serv.resources.currentExpirer().EnsureFreeSpace()
+	if err == expirer.ErrInsufficientStorage {
+		abortWithMessage(c, http.StatusInsufficientStorage, err)
+		return false
+	} else if err != nil {
+		serv.log.Error().
+			Err(err).
+			Msg("Failed to check disk usage")
+	}
+
+	claims, err := serv.processJwt(c.Request)
+	if err != nil {
+		if isFatalJwtError(err) {
+			if jwtValidationErr, ok := err.(*jwt.ValidationError); ok && jwtValidationErr.Inner == jwt.ErrSignatureInvalid {
+				c.Error(jwtValidationErr).SetType(gin.ErrorTypePublic)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, fmt.Sprintf("Failed to process EXTJWT: %s. Configured secret may be incorrect.", jwtValidationErr))
+				return false
 			}
-			serv.log.Warn().
-				Err(err).
-				Msg("Failed to process EXTJWT")
+			abortWithMessage(c, http.StatusBadRequest, err)
+			return false
 		}
+		serv.log.Warn().
+			Err(err).
+			Msg("Failed to process EXTJWT")
+	}
 
-		handler.PostFile(c.Writer, c.Request)
+	if status, err := serv.enforceExtJwtMode(c.Request, err); err != nil {
+		abortWithMessage(c, status, err)
+		return false
 	}
+
+	if serv.rateLimitCreation(c) {
+		return false
+	}
+
+	if status, err := serv.enforceChannelBinding(c.Request); err != nil {
+		abortWithMessage(c, status, err)
+		return false
+	}
+
+	if !serv.checkPolicy(c) {
+		return false
+	}
+
+	// the jti is only claimed once every other check has passed, so that rejected
+	// requests can be retried with the same token
+	if claims != nil && serv.cfg.Server.ExtJwtRejectReplays {
+		if err := serv.claimTokenID(claims); err == errTokenIDStore {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return false
+		} else if err != nil {
+			abortWithMessage(c, http.StatusBadRequest, err)
+			return false
+		}
+	}
+
+	return true
 }
 
 func (serv *UploadServer) addRemoteIPToMetadata(req *http.Request) (err error) {
@@ -203,92 +326,152 @@ func (serv *UploadServer) addRemoteIPToMetadata(req *http.Request) (err error) {
 
 // UnknownIssuerError occurs when a file creation request includes an EXTJWT
 // with an issuer that is not present in the config
-type UnknownIssuerError struct {
-	Issuer string
-}
+type UnknownIssuerError = extjwt.UnknownIssuerError
 
-func (e UnknownIssuerError) Error() string {
-	return fmt.Sprintf("Issuer %#v not configured", e.Issuer)
-}
+// ErrTokenIDRequired occurs when replay protection is enabled and a token lacks jti or exp
+var ErrTokenIDRequired = errors.New("EXTJWT must include jti and exp claims")
 
-func (serv *UploadServer) getSecretForToken(token *jwt.Token) (interface{}, error) {
-	// Don't forget to validate the alg is what you expect:
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-	}
+// ErrTokenReplayed occurs when the jti of a token has already been used
+var ErrTokenReplayed = errors.New("EXTJWT has already been used")
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return nil, fmt.Errorf("Failed to get claims")
-	}
+// errTokenIDStore occurs when the jti of a token could not be recorded
+var errTokenIDStore = errors.New("Failed to record EXTJWT jti")
 
-	issuer, ok := claims["iss"]
-	if !ok {
-		return nil, fmt.Errorf("Issuer field 'iss' missing from JWT")
-	}
+// metadata fields derived from EXTJWT claims, which clients cannot set themselves
+var jwtMetadataFields = []string{"account", "issuer", "nick", "channel", "umodes", "cmodes"}
 
-	issuerStr, ok := issuer.(string)
-	if !ok {
-		return nil, fmt.Errorf("Failed to coerce issuer to string")
-	}
-
-	secret, ok := serv.cfg.JwtSecretsByIssuer[issuerStr]
-	if !ok {
-		return nil, &UnknownIssuerError{Issuer: issuerStr}
-	}
-
-	return []byte(secret), nil
-}
-
-func (serv *UploadServer) processJwt(req *http.Request) (err error) {
+func (serv *UploadServer) processJwt(req *http.Request) (claims jwt.MapClaims, err error) {
 	metadata := parseMeta(req.Header.Get("Upload-Metadata"))
 
-	// ensure the client doesn't attempt to specify their own account/issuer fields
-	for k := range metadata {
-		switch k {
-		case "account":
-		case "issuer":
-			return fmt.Errorf("Metadata field %#v cannot be set by client", k)
+	// ensure the client doesn't attempt to specify fields derived from the token
+	for _, field := range jwtMetadataFields {
+		if _, ok := metadata[field]; ok {
+			return nil, fmt.Errorf("Metadata field %#v cannot be set by client", field)
 		}
 	}
 
 	tokenString := metadata["extjwt"]
 	if tokenString == "" {
-		return nil
+		return nil, serv.checkAnnouncement(metadata, nil)
 	}
 
-	token, err := jwt.Parse(tokenString, serv.getSecretForToken)
+	token, err := serv.jwtVerifier.Parse(tokenString)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok || !token.Valid {
-		return
+		return nil, nil
 	}
 
 	issuer := claims["iss"].(string)
-	account, ok := claims["account"].(string)
-	if !ok {
-		return nil
+
+	if serv.cfg.Server.ExtJwtRejectReplays {
+		if _, _, err := tokenID(claims); err != nil {
+			return nil, err
+		}
 	}
 
 	metadata["issuer"] = issuer
-	metadata["account"] = account
+
+	account, ok := claims["account"].(string)
+	if ok {
+		metadata["account"] = account
+	}
+
+	// record who uploaded the file, and where to, for moderators. webircgateway gives
+	// the nick in a "nick" claim rather than "sub".
+	if nick, ok := claims["sub"].(string); ok {
+		metadata["nick"] = nick
+	} else if nick, ok := claims["nick"].(string); ok {
+		metadata["nick"] = nick
+	}
+	if channel, ok := claims["channel"].(string); ok {
+		metadata["channel"] = channel
+	}
+	if err = serv.checkAnnouncement(metadata, claims); err != nil {
+		return nil, err
+	}
+	for _, modesClaim := range []string{"umodes", "cmodes"} {
+		modes, err := extjwt.StringsClaim(claims, modesClaim)
+		if err == nil && len(modes) > 0 {
+			metadata[modesClaim] = strings.Join(modes, "")
+		}
+	}
 
 	// override original header
 	req.Header.Set("Upload-Metadata", serializeMeta(metadata))
 
-	fmt.Printf("metadata updated: account=%v issuer=%v\n", account, issuer)
+	serv.log.Debug().
+		Str("event", "jwt_processed").
+		Str("issuer", issuer).
+		Str("account", account).
+		Str("nick", metadata["nick"]).
+		Str("channel", metadata["channel"]).
+		Msg("Upload metadata updated from EXTJWT")
 	return
 }
 
+// tokenID returns the jti and expiry of a token, which replay protection requires
+func tokenID(claims jwt.MapClaims) (jti string, exp time.Time, err error) {
+	jti, _ = claims["jti"].(string)
+	exp, ok, err := extjwt.NumericDate(claims, "exp")
+	if jti == "" || !ok || err != nil {
+		return "", time.Time{}, ErrTokenIDRequired
+	}
+	return jti, exp, nil
+}
+
+// claimTokenID records the jti of a token processed by processJwt, rejecting tokens
+// that have been used before
+func (serv *UploadServer) claimTokenID(claims jwt.MapClaims) error {
+	jti, exp, err := tokenID(claims)
+	if err != nil {
+		return err
+	}
+	issuer, _ := claims["iss"].(string)
+
+	// keep the jti as long as the token could still be accepted
+	fresh, err := serv.store.ClaimTokenID(issuer, jti, exp.Add(serv.cfg.Server.ExtJwtClockSkew.Duration))
+	if err != nil {
+		serv.log.Error().
+			Err(err).
+			Msg("Failed to record EXTJWT jti")
+		return errTokenIDStore
+	}
+	if !fresh {
+		return ErrTokenReplayed
+	}
+	return nil
+}
+
+// ErrHeldDownload occurs when a non-admin requests an upload that is under hold
+var ErrHeldDownload = errors.New("Upload is held and only available to admins")
+
 // ErrInvalidXForwardedFor occurs if the X-Forwarded-For header is trusted but invalid
 var ErrInvalidXForwardedFor = errors.New("Failed to parse IP from X-Forwarded-For header")
 
+// directRemoteIP returns the IP of the peer connected to the server
+func directRemoteIP(req *http.Request) (string, error) {
+	if _, ok := req.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		// peers on a unix socket are local processes, typically a reverse proxy
+		return "127.0.0.1", nil
+	}
+	remoteIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	return remoteIP, err
+}
+
+// peerIsTrusted reports whether the peer connected to the server is a trusted reverse
+// proxy, whose forwarding headers are honored
+func (serv *UploadServer) peerIsTrusted(req *http.Request) bool {
+	remoteIP, err := directRemoteIP(req)
+	return err == nil && serv.remoteIPisTrusted(net.ParseIP(remoteIP))
+}
+
 func (serv *UploadServer) getDirectOrForwardedRemoteIP(req *http.Request) (string, error) {
 	// extract direct IP
-	remoteIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	remoteIP, err := directRemoteIP(req)
 	if err != nil {
 		serv.log.Error().
 			Err(err).
@@ -298,7 +481,7 @@ func (serv *UploadServer) getDirectOrForwardedRemoteIP(req *http.Request) (strin
 
 	// use X-Forwarded-For header if direct IP is a trusted reverse proxy
 	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		if serv.remoteIPisTrusted(net.ParseIP(remoteIP)) {
+		if serv.peerIsTrusted(req) {
 			// We do not check intermediary proxies against the whitelist.
 			// If a trusted proxy is appending to and forwarding the value of the
 			// header it is receiving, that is an implicit expression of trust
@@ -348,7 +531,7 @@ func (serv *UploadServer) ipRecorder(broadcaster *events.TusEventBroadcaster) {
 			return // channel closed
 		}
 		if event.Type == hooks.HookPostCreate {
-			go func() {
+			serv.background(func() {
 				ip := event.Info.MetaData["RemoteIP"]
 
 				serv.log.Debug().
@@ -367,7 +550,55 @@ func (serv *UploadServer) ipRecorder(broadcaster *events.TusEventBroadcaster) {
 						Err(err).
 						Msg("Failed to record uploader IP")
 				}
-			}()
+			})
+		}
+	}
+}
+
+// heldDownloadGuard wraps a GET handler and restricts downloads of held uploads to
+// admins when configured
+func (serv *UploadServer) heldDownloadGuard(getFile gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if serv.cfg.Admin.HeldDownloadsAdminOnly {
+			held, err := serv.store.IsHeld(c.Param("id"))
+			if err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+				return
+			}
+			if held && !hasAdminToken(c.Request, serv.cfg.Admin.Tokens) {
+				c.AbortWithError(http.StatusForbidden, ErrHeldDownload).SetType(gin.ErrorTypePublic)
+				return
+			}
+		}
+
+		getFile(c)
+	}
+}
+
+// downloadRecorder wraps a GET handler and records the time of successful downloads,
+// used to determine least-recently-downloaded uploads for eviction
+func (serv *UploadServer) downloadRecorder(getFile gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getFile(c)
+
+		if c.Writer.Status() != http.StatusOK {
+			return
 		}
+
+		id := c.Param("id")
+		serv.background(func() {
+			_, err := serv.DBConn.DB.Exec(`
+				UPDATE uploads
+				SET last_downloaded_at = ?
+				WHERE id = ?
+			`, time.Now().Unix(), id)
+
+			if err != nil {
+				serv.log.Error().
+					Err(err).
+					Str("id", id).
+					Msg("Failed to record download time")
+			}
+		})
 	}
 }
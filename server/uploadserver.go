@@ -1,14 +1,17 @@
 package server
 
 import (
-	"net/http"
+	"context"
 	"sync"
 
 	"github.com/gin-gonic/gin"
 	"github.com/kiwiirc/plugin-fileuploader/db"
 	"github.com/kiwiirc/plugin-fileuploader/events"
 	"github.com/kiwiirc/plugin-fileuploader/expirer"
+	"github.com/kiwiirc/plugin-fileuploader/extjwt"
+	"github.com/kiwiirc/plugin-fileuploader/fetcher"
 	"github.com/kiwiirc/plugin-fileuploader/logging"
+	"github.com/kiwiirc/plugin-fileuploader/policy"
 	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
 	"github.com/rs/zerolog"
 )
@@ -22,8 +25,16 @@ type UploadServer struct {
 	cfg                 Config
 	log                 *zerolog.Logger
 	store               *shardedfilestore.ShardedFileStore
-	expirer             *expirer.Expirer
-	httpServer          *http.Server
+	policies            *policy.Table
+	jwtVerifier         *extjwt.Verifier
+	resources           *sharedResources
+	rateLimiters        *rateLimiters
+	bandwidth           *bandwidthLimiters
+	bans                *banList
+	announcer           Announcer
+	fetcher             *fetcher.Fetcher
+	requests            activityTracker // in-flight requests
+	backgroundTasks     activityTracker // database writes outliving their request
 	startedMu           sync.Mutex
 	started             chan struct{}
 	tusEventBroadcaster *events.TusEventBroadcaster
@@ -45,74 +56,123 @@ func init() {
 	gin.SetMode(gin.ReleaseMode)
 }
 
-// Run starts the UploadServer
-func (serv *UploadServer) Run(replaceableHandler *ReplaceableHandler) error {
-	serv.Router = gin.New()
-	serv.Router.Use(logging.GinLogger(serv.log), gin.Recovery())
+func newExpirerConfig(cfg *Config) expirer.Config {
+	return expirer.Config{
+		MaxAge:             cfg.Expiration.MaxAge.Duration,
+		IdentifiedMaxAge:   cfg.Expiration.IdentifiedMaxAge.Duration,
+		CheckInterval:      cfg.Expiration.CheckInterval.Duration,
+		JwtSecretsByIssuer: cfg.JwtSecretsByIssuer,
+		Policies:           newPolicyTable(cfg).Policies,
+		BatchSize:          cfg.Expiration.BatchSize,
+		Concurrency:        cfg.Expiration.Concurrency,
+		HighWatermark:      cfg.Expiration.HighWatermark.Fraction,
+		LowWatermark:       cfg.Expiration.LowWatermark.Fraction,
+		EvictionOrder:      cfg.Expiration.EvictionOrder,
+	}
+}
 
-	serv.DBConn = db.ConnectToDB(serv.log, db.DBConfig{
-		DriverName: serv.cfg.Database.Type,
-		DSN:        serv.cfg.Database.Path,
+// newJwtVerifier loads the secrets and public keys of all configured issuers
+func newJwtVerifier(cfg *Config) (*extjwt.Verifier, error) {
+	verifier := extjwt.NewVerifier()
+	verifier.SetValidation(extjwt.Validation{
+		Audience: cfg.Server.ExtJwtAudience,
+		Leeway:   cfg.Server.ExtJwtClockSkew.Duration,
 	})
 
-	serv.store = shardedfilestore.New(
-		serv.cfg.Storage.Path,
-		serv.cfg.Storage.ShardLayers,
-		serv.DBConn,
-		serv.log,
-	)
-
-	serv.expirer = expirer.New(
-		serv.store,
-		serv.cfg.Expiration.MaxAge.Duration,
-		serv.cfg.Expiration.IdentifiedMaxAge.Duration,
-		serv.cfg.Expiration.CheckInterval.Duration,
-		serv.cfg.JwtSecretsByIssuer,
-		serv.log,
-	)
-
-	err := serv.registerTusHandlers(serv.Router, serv.store)
+	for issuer, secret := range cfg.JwtSecretsByIssuer {
+		verifier.AddSecret(issuer, secret)
+	}
+
+	for issuer, issuerCfg := range cfg.JwtIssuers {
+		if issuerCfg.Secret != "" {
+			verifier.AddSecret(issuer, issuerCfg.Secret)
+		}
+		if issuerCfg.PublicKeyFile != "" {
+			keys, err := extjwt.LoadPEMFile(issuerCfg.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			verifier.AddKeys(issuer, keys...)
+		}
+		if issuerCfg.JwksFile != "" {
+			keys, err := extjwt.LoadJWKSFile(issuerCfg.JwksFile)
+			if err != nil {
+				return nil, err
+			}
+			verifier.AddKeys(issuer, keys...)
+		}
+		if issuerCfg.Audience != nil {
+			verifier.SetAudience(issuer, issuerCfg.Audience)
+		}
+	}
+
+	return verifier, nil
+}
+
+// Run starts the UploadServer
+func (serv *UploadServer) Run(replaceableHandler *ReplaceableHandler) error {
+	jwtVerifier, err := newJwtVerifier(&serv.cfg)
 	if err != nil {
 		return err
 	}
+	serv.jwtVerifier = jwtVerifier
 
-	// closed channel indicates that startup is complete
-	close(serv.GetStartedChan())
+	serv.Router = gin.New()
+	serv.Router.Use(logging.GinLogger(serv.log), gin.Recovery(), serv.trackRequests)
 
-	if replaceableHandler != nil {
-		// set ReplaceableHandler that's mounted in an external server
-		replaceableHandler.Handler = serv.Router
-		return nil
+	// the database, store and expirer are shared by successive instances
+	if serv.resources == nil {
+		serv.resources = newSharedResources(&serv.cfg, serv.log)
 	}
+	serv.DBConn = serv.resources.dbConn
+	serv.store = serv.resources.store
 
-	// otherwise run our own http server
-	serv.httpServer = &http.Server{
-		Addr:    serv.cfg.Server.ListenAddress,
-		Handler: serv.Router,
+	serv.policies = newPolicyTable(&serv.cfg)
+	serv.bans = newBanList(serv.store, serv.cfg.Bans.RefreshInterval.Duration)
+	if serv.cfg.Fetch.Enabled {
+		serv.fetcher = newFetcher(&serv.cfg, serv.policies)
 	}
 
-	return serv.httpServer.ListenAndServe()
+	err = serv.registerTusHandlers(serv.Router, serv.store)
+	if err != nil {
+		return err
+	}
+
+	err = serv.registerAdminHandlers(serv.Router)
+	if err != nil {
+		return err
+	}
+
+	// closed channel indicates that startup is complete
+	close(serv.GetStartedChan())
+
+	// set ReplaceableHandler that's mounted in an external server, or served by the
+	// RunContext in standalone mode
+	replaceableHandler.Replace(serv.Router, serv.routePrefixes())
+	return nil
 }
 
-// Shutdown gracefully terminates the UploadServer instance.
-// The HTTP listen socket will close immediately, causing the .Run() call to return.
-// The call to .Shutdown() will block until all outstanding requests have been served and
-// other resources like database connections and timers have been closed and stopped.
-func (serv *UploadServer) Shutdown() {
+// Shutdown terminates the UploadServer instance. New requests are refused while the
+// outstanding ones are given until the context is done to complete. The shared database,
+// store and expirer are left running for the next instance, the RunContext closes them
+// on final shutdown.
+func (serv *UploadServer) Shutdown(ctx context.Context) {
 	// wait for startup to complete
 	<-serv.GetStartedChan()
 
-	// wait for all requests to finish
-	if serv.httpServer != nil {
-		serv.httpServer.Shutdown(nil)
+	if err := serv.requests.close(ctx); err != nil {
+		serv.log.Warn().
+			Str("event", "shutdown_deadline").
+			Msg("Shutdown deadline reached with requests still in progress")
 	}
-
-	// stop running FileStore GC cycles
-	serv.expirer.Stop()
-
-	// close db connections
-	serv.DBConn.DB.Close()
+	serv.backgroundTasks.close(ctx)
 
 	// close event broadcaster
 	serv.tusEventBroadcaster.Close()
 }
+
+// routePrefixes returns the URL path prefixes handled by the server
+func (serv *UploadServer) routePrefixes() []string {
+	prefixes, _ := servedRoutePrefixes(&serv.cfg)
+	return prefixes
+}
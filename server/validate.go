@@ -0,0 +1,281 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/kiwiirc/plugin-fileuploader/expirer"
+	"github.com/kiwiirc/plugin-fileuploader/extjwt"
+)
+
+// maxShardLayers is the largest supported Storage.ShardLayers. Each layer takes one
+// character of the key it shards, and upload IDs, 32 hex characters, are the shortest
+// key sharded. Hashes are 64 characters.
+const maxShardLayers = 32
+
+// ConfigErrors lists every problem found in a config
+type ConfigErrors []error
+
+func (errs ConfigErrors) Error() string {
+	return strings.Join(errs.Strings(), "\n")
+}
+
+// Strings returns the messages of the errors
+func (errs ConfigErrors) Strings() []string {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return messages
+}
+
+// LoadConfig loads the config file over the defaults, applies the overrides and validates
+// the result. Invalid configs return ConfigErrors.
+func LoadConfig(configPath string, overrides Overrides) (*Config, error) {
+	cfg := NewConfig()
+	md, err := cfg.Load(configPath, overrides)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs ConfigErrors
+	for _, key := range md.Undecoded() {
+		errs = append(errs, fmt.Errorf("%s: unknown key", key))
+	}
+	errs = append(errs, cfg.Validate()...)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cfg, nil
+}
+
+// Validate checks every setting, including that paths are writable and that logger
+// outputs can be opened
+func (cfg *Config) Validate() (errs ConfigErrors) {
+	check := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", key, err))
+		}
+	}
+
+	check("Server.ListenAddress", validateListenAddress(cfg.Server.ListenAddress))
+	if cfg.Server.RedirectAddress != "" {
+		check("Server.RedirectAddress", validateListenAddress(cfg.Server.RedirectAddress))
+		if cfg.Server.TLSCert == "" {
+			check("Server.RedirectAddress", errors.New("requires TLSCert"))
+		}
+	}
+	switch {
+	case cfg.Server.TLSCert == "" && cfg.Server.TLSKey == "":
+	case cfg.Server.TLSCert == "" || cfg.Server.TLSKey == "":
+		check("Server.TLSCert", errors.New("TLSCert and TLSKey must be set together"))
+	default:
+		_, err := tls.LoadX509KeyPair(cfg.Server.TLSCert, cfg.Server.TLSKey)
+		check("Server.TLSCert", err)
+	}
+	check("Server.ShutdownTimeout", positive(cfg.Server.ShutdownTimeout))
+	_, err := routePrefixFromBasePath(cfg.Server.BasePath)
+	check("Server.BasePath", err)
+	check("Server.ExtJwtClockSkew", notNegative(cfg.Server.ExtJwtClockSkew))
+
+	check("Storage.Path", writableDir(cfg.Storage.Path))
+	if cfg.Storage.ShardLayers < 0 || cfg.Storage.ShardLayers > maxShardLayers {
+		check("Storage.ShardLayers", fmt.Errorf("must be between 0 and %d", maxShardLayers))
+	}
+
+	switch cfg.Database.Type {
+	case "sqlite3", "mysql":
+		check("Database.Path", validateDSN(cfg.Database.Type, cfg.Database.Path))
+	default:
+		check("Database.Type", fmt.Errorf("unsupported database type %#v", cfg.Database.Type))
+	}
+
+	check("Expiration.MaxAge", positive(cfg.Expiration.MaxAge))
+	check("Expiration.IdentifiedMaxAge", positive(cfg.Expiration.IdentifiedMaxAge))
+	check("Expiration.CheckInterval", notNegative(cfg.Expiration.CheckInterval))
+	if cfg.Expiration.BatchSize <= 0 {
+		check("Expiration.BatchSize", errors.New("must be positive"))
+	}
+	if cfg.Expiration.Concurrency <= 0 {
+		check("Expiration.Concurrency", errors.New("must be positive"))
+	}
+	if cfg.Expiration.HighWatermark.Fraction > 0 && cfg.Expiration.LowWatermark.Fraction > cfg.Expiration.HighWatermark.Fraction {
+		check("Expiration.LowWatermark", errors.New("must not exceed HighWatermark"))
+	}
+	switch cfg.Expiration.EvictionOrder {
+	case expirer.EvictOldest, expirer.EvictLeastRecentlyDownloaded:
+	default:
+		check("Expiration.EvictionOrder", fmt.Errorf("unsupported order %#v", cfg.Expiration.EvictionOrder))
+	}
+
+	for key, value := range map[string]int{
+		"RateLimit.UploadsPerMinute":        cfg.RateLimit.UploadsPerMinute,
+		"RateLimit.UploadBurst":             cfg.RateLimit.UploadBurst,
+		"RateLimit.AccountUploadsPerMinute": cfg.RateLimit.AccountUploadsPerMinute,
+		"RateLimit.AccountUploadBurst":      cfg.RateLimit.AccountUploadBurst,
+	} {
+		if value < 0 {
+			check(key, errors.New("must not be negative"))
+		}
+	}
+
+	check("Bans.RefreshInterval", positive(cfg.Bans.RefreshInterval))
+
+	if len(cfg.Admin.Tokens) > 0 {
+		adminPrefix, err := routePrefixFromBasePath(cfg.Admin.BasePath)
+		check("Admin.BasePath", err)
+		if prefix, _ := routePrefixFromBasePath(cfg.Server.BasePath); err == nil && adminPrefix == prefix {
+			check("Admin.BasePath", errors.New("must differ from Server.BasePath"))
+		}
+	}
+	for i, token := range cfg.Admin.Tokens {
+		if token == "" {
+			check(fmt.Sprintf("Admin.Tokens[%d]", i), errors.New("must not be empty"))
+		}
+	}
+
+	if cfg.Fetch.Enabled {
+		check("Fetch.Timeout", positive(cfg.Fetch.Timeout))
+		if cfg.Fetch.MaxRedirects < 0 {
+			check("Fetch.MaxRedirects", errors.New("must not be negative"))
+		}
+	}
+
+	if cfg.Announce.Enabled {
+		switch strings.ToUpper(cfg.Announce.Command) {
+		case "NOTICE", "PRIVMSG":
+		default:
+			check("Announce.Command", fmt.Errorf("unsupported command %#v", cfg.Announce.Command))
+		}
+		_, err := cfg.announceBaseURL()
+		check("Announce.BaseURL", err)
+	}
+
+	for issuer, secret := range cfg.JwtSecretsByIssuer {
+		if secret == "" {
+			check(fmt.Sprintf("JwtSecretsByIssuer.%q", issuer), errors.New("must not be empty"))
+		}
+	}
+	for issuer, issuerCfg := range cfg.JwtIssuers {
+		key := fmt.Sprintf("JwtIssuers.%q", issuer)
+		if issuerCfg.Secret == "" && issuerCfg.PublicKeyFile == "" && issuerCfg.JwksFile == "" && cfg.JwtSecretsByIssuer[issuer] == "" {
+			check(key, errors.New("needs a Secret, PublicKeyFile or JwksFile"))
+		}
+		if issuerCfg.PublicKeyFile != "" {
+			_, err := extjwt.LoadPEMFile(issuerCfg.PublicKeyFile)
+			check(key+".PublicKeyFile", err)
+		}
+		if issuerCfg.JwksFile != "" {
+			_, err := extjwt.LoadJWKSFile(issuerCfg.JwksFile)
+			check(key+".JwksFile", err)
+		}
+	}
+
+	for i, p := range cfg.Policies {
+		key := fmt.Sprintf("Policies[%d]", i)
+		check(key+".MaxAge", notNegative(p.MaxAge))
+		check(key+".IdentifiedMaxAge", notNegative(p.IdentifiedMaxAge))
+	}
+
+	for i, loggerCfg := range cfg.Loggers {
+		key := fmt.Sprintf("Loggers[%d]", i)
+		if loggerCfg.Format.string == "" {
+			check(key+".Format", errors.New("missing log format"))
+		}
+		output, err := openLogOutput(loggerCfg.Output)
+		check(key+".Output", err)
+		if closer, ok := output.(io.Closer); ok && err == nil && output != os.Stderr && output != os.Stdout {
+			closer.Close()
+		}
+	}
+
+	return errs
+}
+
+func positive(d duration) error {
+	if d.Duration <= 0 {
+		return errors.New("must be positive")
+	}
+	return nil
+}
+
+func notNegative(d duration) error {
+	if d.Duration < 0 {
+		return errors.New("must not be negative")
+	}
+	return nil
+}
+
+func validateListenAddress(address string) error {
+	if strings.HasPrefix(address, unixAddressPrefix) {
+		return writableDir(filepath.Dir(strings.TrimPrefix(address, unixAddressPrefix)))
+	}
+	_, _, err := net.SplitHostPort(address)
+	return err
+}
+
+// writableDir checks that files can be created in the directory, or in the closest
+// existing parent when it is yet to be created
+func writableDir(path string) error {
+	if path == "" {
+		return errors.New("must not be empty")
+	}
+
+	dir := path
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+
+	file, err := ioutil.TempFile(dir, ".fileuploader-check")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func validateDSN(driver, dsn string) error {
+	if driver == "mysql" {
+		_, err := mysql.ParseDSN(dsn)
+		return err
+	}
+
+	// sqlite3 paths may be followed by connection options, and prefixed with file:
+	path := strings.TrimPrefix(dsn, "file:")
+	if i := strings.Index(path, "?"); i >= 0 {
+		if _, err := url.ParseQuery(path[i+1:]); err != nil {
+			return err
+		}
+		path = path[:i]
+	}
+	if path == "" || path == ":memory:" {
+		return nil
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return writableDir(filepath.Dir(path))
+}
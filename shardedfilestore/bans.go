@@ -0,0 +1,129 @@
+package shardedfilestore
+
+import (
+	"database/sql"
+	"net"
+	"time"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+)
+
+// Ban refuses service to clients with an address in the given range
+type Ban struct {
+	CIDR      string `db:"cidr" json:"cidr"`
+	Reason    string `db:"reason" json:"reason"`
+	Actor     string `db:"actor" json:"actor"`
+	CreatedAt int64  `db:"created_at" json:"createdAt"`
+	ExpiresAt *int64 `db:"expires_at" json:"expiresAt,omitempty"` // never expires when nil
+}
+
+// Network parses the range of the ban
+func (ban *Ban) Network() (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(ban.CIDR)
+	return network, err
+}
+
+// AddBan bans a range, replacing any existing ban of the same range. A zero expiresAt
+// makes the ban permanent.
+func (store *ShardedFileStore) AddBan(network *net.IPNet, reason, actor string, expiresAt time.Time) error {
+	var expires sql.NullInt64
+	if !expiresAt.IsZero() {
+		expires = sql.NullInt64{Int64: expiresAt.Unix(), Valid: true}
+	}
+
+	tx, err := store.DBConn.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cidr := network.String()
+	_, err = tx.Exec(`DELETE FROM bans WHERE cidr = ?`, cidr)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO bans(cidr, reason, actor, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, cidr, nullString(reason), nullString(actor), time.Now().Unix(), expires)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveBan lifts the ban of a range
+func (store *ShardedFileStore) RemoveBan(network *net.IPNet) error {
+	return db.UpdateRow(store.DBConn.DB, `DELETE FROM bans WHERE cidr = ?`, network.String())
+}
+
+// ListBans returns the bans that have not expired
+func (store *ShardedFileStore) ListBans() (bans []Ban, err error) {
+	bans = []Ban{}
+	err = store.DBConn.DB.Select(&bans, `
+		SELECT
+			cidr,
+			COALESCE(reason, '') AS reason,
+			COALESCE(actor, '') AS actor,
+			created_at,
+			expires_at
+		FROM bans
+		WHERE expires_at IS NULL OR expires_at > ?
+		ORDER BY created_at
+	`, time.Now().Unix())
+	return
+}
+
+// PurgeExpiredBans deletes bans that expired before the given time
+func (store *ShardedFileStore) PurgeExpiredBans(before time.Time) (int64, error) {
+	result, err := store.DBConn.DB.Exec(`
+		DELETE FROM bans WHERE expires_at < ?
+	`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// banTerminationPageSize is how many uploads TerminateUploadsFrom examines at a time
+const banTerminationPageSize = 500
+
+// TerminateUploadsFrom terminates all uploads made from an address in the range.
+// Held uploads are skipped. Returns the IDs of terminated uploads.
+func (store *ShardedFileStore) TerminateUploadsFrom(network *net.IPNet) (terminated []string, err error) {
+	terminated = []string{}
+	lastID := ""
+	for {
+		var uploads []struct {
+			ID         string `db:"id"`
+			UploaderIP string `db:"uploader_ip"`
+		}
+		err = store.DBConn.DB.Select(&uploads, `
+			SELECT id, uploader_ip FROM uploads
+			WHERE id > ? AND deleted = 0 AND held = 0 AND uploader_ip IS NOT NULL
+			ORDER BY id
+			LIMIT ?
+		`, lastID, banTerminationPageSize)
+		if err != nil {
+			return terminated, err
+		}
+		if len(uploads) == 0 {
+			return terminated, nil
+		}
+		lastID = uploads[len(uploads)-1].ID
+
+		for _, upload := range uploads {
+			if !network.Contains(net.ParseIP(upload.UploaderIP)) {
+				continue
+			}
+			if err := store.Terminate(upload.ID); err != nil {
+				store.log.Error().
+					Err(err).
+					Str("id", upload.ID).
+					Msg("Failed to terminate upload from banned range")
+				continue
+			}
+			terminated = append(terminated, upload.ID)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package shardedfilestore
+
+import (
+	"database/sql"
+)
+
+// ChannelBinding identifies the channel an upload is restricted to
+type ChannelBinding struct {
+	Issuer  string `db:"jwt_issuer"`
+	Channel string `db:"jwt_channel"`
+}
+
+// GetChannelBinding returns the channel an upload can only be downloaded from, or nil
+// if the upload is not bound to a channel
+func (store *ShardedFileStore) GetChannelBinding(id string) (*ChannelBinding, error) {
+	binding := &ChannelBinding{}
+	err := store.DBConn.DB.Get(binding, `
+		SELECT
+			COALESCE(jwt_issuer, '') AS jwt_issuer,
+			COALESCE(jwt_channel, '') AS jwt_channel
+		FROM uploads
+		WHERE id = ? AND channel_only = 1
+	`, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return binding, nil
+}
@@ -0,0 +1,43 @@
+package shardedfilestore
+
+import "sync"
+
+// hashLocks serializes the changes to uploads sharing a deduplicated .bin, so that the
+// last of them to be terminated removes it and no upload being finished loses it
+type hashLocks struct {
+	mu    sync.Mutex
+	locks map[string]*hashLock
+}
+
+type hashLock struct {
+	sync.Mutex
+	users int // callers holding or waiting for the lock
+}
+
+// lock locks the given hash and returns the function unlocking it
+func (hl *hashLocks) lock(hash []byte) (unlock func()) {
+	key := string(hash)
+
+	hl.mu.Lock()
+	if hl.locks == nil {
+		hl.locks = make(map[string]*hashLock)
+	}
+	l := hl.locks[key]
+	if l == nil {
+		l = &hashLock{}
+		hl.locks[key] = l
+	}
+	l.users++
+	hl.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		hl.mu.Lock()
+		defer hl.mu.Unlock()
+		if l.users--; l.users == 0 {
+			delete(hl.locks, key)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package shardedfilestore
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/tus/tusd"
+)
+
+// ErrUploadHeld occurs when attempting to terminate an upload that is under hold
+var ErrUploadHeld = tusd.NewHTTPError(errors.New("Upload is held and cannot be deleted"), http.StatusLocked)
+
+// ErrUploadNotFound occurs when an upload does not exist
+var ErrUploadNotFound = errors.New("Upload not found")
+
+// Hold describes an upload that is protected from deletion
+type Hold struct {
+	ID       string `db:"id" json:"id"`
+	Reason   string `db:"hold_reason" json:"reason"`
+	Actor    string `db:"hold_actor" json:"actor"`
+	HeldAt   int64  `db:"held_at" json:"heldAt"`
+	Deleted  bool   `db:"deleted" json:"deleted"`
+	Uploader string `db:"uploader_ip" json:"uploaderIP"`
+	Nick     string `db:"jwt_nick" json:"nick,omitempty"`
+	Channel  string `db:"jwt_channel" json:"channel,omitempty"`
+}
+
+// SetHold protects an upload from expiry, eviction and termination.
+// Uploads that have already been deleted cannot be held.
+func (store *ShardedFileStore) SetHold(id, reason, actor string) error {
+	return db.UpdateRow(store.DBConn.DB, `
+		UPDATE uploads
+		SET held = 1, hold_reason = ?, hold_actor = ?, held_at = ?
+		WHERE id = ? AND deleted = 0
+	`, reason, actor, time.Now().Unix(), id)
+}
+
+// ClearHold removes the hold from an upload. Clearing an upload that is not held
+// succeeds, as MySQL reports no affected rows when nothing changes.
+func (store *ShardedFileStore) ClearHold(id string) error {
+	res, err := store.DBConn.DB.Exec(`
+		UPDATE uploads
+		SET held = 0, hold_reason = NULL, hold_actor = NULL, held_at = NULL
+		WHERE id = ?
+	`, id)
+	if err != nil {
+		return err
+	}
+	if count, err := res.RowsAffected(); err != nil || count > 0 {
+		return err
+	}
+
+	var exists bool
+	err = store.DBConn.DB.Get(&exists, `SELECT COUNT(*) > 0 FROM uploads WHERE id = ?`, id)
+	if err == nil && !exists {
+		err = ErrUploadNotFound
+	}
+	return err
+}
+
+// IsHeld reports whether an upload is under hold
+func (store *ShardedFileStore) IsHeld(id string) (held bool, err error) {
+	err = store.DBConn.DB.Get(&held, `SELECT held FROM uploads WHERE id = ?`, id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return
+}
+
+// ListHolds returns all uploads under hold
+func (store *ShardedFileStore) ListHolds() (holds []Hold, err error) {
+	holds = []Hold{}
+	err = store.DBConn.DB.Select(&holds, `
+		SELECT
+			id,
+			COALESCE(hold_reason, '') AS hold_reason,
+			COALESCE(hold_actor, '') AS hold_actor,
+			COALESCE(held_at, 0) AS held_at,
+			deleted,
+			COALESCE(uploader_ip, '') AS uploader_ip,
+			COALESCE(jwt_nick, '') AS jwt_nick,
+			COALESCE(jwt_channel, '') AS jwt_channel
+		FROM uploads
+		WHERE held = 1
+		ORDER BY held_at
+	`)
+	return
+}
@@ -71,6 +71,99 @@ func (store *ShardedFileStore) initDB() {
 					`ALTER TABLE new_uploads RENAME TO uploads;`,
 				},
 			},
+			{
+				Id: "5",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD last_downloaded_at INTEGER(8)
+					;`,
+				},
+			},
+			{
+				Id: "6",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD size INTEGER(8)
+					;`,
+					`
+					ALTER TABLE uploads
+						ADD mime_type VARCHAR(255)
+					;`,
+				},
+			},
+			{
+				Id: "7",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD held INTEGER(1) DEFAULT 0 NOT NULL
+					;`,
+					`
+					ALTER TABLE uploads
+						ADD hold_reason TEXT
+					;`,
+					`
+					ALTER TABLE uploads
+						ADD hold_actor TEXT
+					;`,
+					`
+					ALTER TABLE uploads
+						ADD held_at INTEGER(8)
+					;`,
+				},
+			},
+			{
+				Id: "8",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD jwt_nick TEXT
+					;`,
+					`
+					ALTER TABLE uploads
+						ADD jwt_channel TEXT
+					;`,
+					`
+					ALTER TABLE uploads
+						ADD jwt_umodes TEXT
+					;`,
+					`
+					ALTER TABLE uploads
+						ADD jwt_cmodes TEXT
+					;`,
+					`
+					CREATE TABLE used_token_ids(
+						issuer VARCHAR(255) NOT NULL,
+						jti VARCHAR(255) NOT NULL,
+						expires_at INTEGER(8) NOT NULL,
+						PRIMARY KEY (issuer, jti)
+					);`,
+				},
+			},
+			{
+				Id: "9",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD channel_only INTEGER(1) DEFAULT 0 NOT NULL
+					;`,
+				},
+			},
+			{
+				Id: "10",
+				Up: []string{
+					`
+					CREATE TABLE bans(
+						cidr VARCHAR(49) PRIMARY KEY,
+						reason TEXT,
+						actor TEXT,
+						created_at INTEGER(8) NOT NULL,
+						expires_at INTEGER(8)
+					);`,
+				},
+			},
 		},
 	}
 
@@ -7,12 +7,15 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql" // register mysql driver
@@ -35,6 +38,9 @@ type ShardedFileStore struct {
 	PrefixShardLayers int    // Number of extra directory layers to prefix file paths with.
 	DBConn            *db.DatabaseConnection
 	log               *zerolog.Logger
+	finishMu          sync.RWMutex // held for reading while finishing uploads
+	drained           bool         // set once Drain has been called
+	hashLocks         hashLocks    // held while changing uploads that share a .bin
 }
 
 // New creates a new file based storage backend. The directory specified will
@@ -84,14 +90,22 @@ func (store *ShardedFileStore) NewUpload(info tusd.FileInfo) (id string, err err
 	}
 
 	// create record in uploads table
-	if info.MetaData["account"] == "" {
-		err = db.UpdateRow(store.DBConn.DB, `INSERT INTO uploads(id, created_at) VALUES (?, ?)`, id, time.Now().Unix())
-	} else {
-		err = db.UpdateRow(store.DBConn.DB,
-			`INSERT INTO uploads(id, created_at, jwt_account, jwt_issuer) VALUES (?, ?, ?, ?)`,
-			id, time.Now().Unix(), info.MetaData["account"], info.MetaData["issuer"],
-		)
-	}
+	err = db.UpdateRow(store.DBConn.DB, `
+		INSERT INTO uploads(id, created_at, size, mime_type, jwt_account, jwt_issuer, jwt_nick, jwt_channel, jwt_umodes, jwt_cmodes, channel_only)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+		id,
+		time.Now().Unix(),
+		info.Size,
+		nullString(MimeType(info.MetaData)),
+		nullString(info.MetaData["account"]),
+		nullString(info.MetaData["issuer"]),
+		nullString(info.MetaData["nick"]),
+		nullString(info.MetaData["channel"]),
+		nullString(info.MetaData["umodes"]),
+		nullString(info.MetaData["cmodes"]),
+		info.MetaData["channelonly"] != "",
+	)
 	if err != nil {
 		return "", err
 	}
@@ -201,6 +215,10 @@ func RemoveWithDirs(path string, basePath string) (err error) {
 		}
 
 		empty, err := isDirEmpty(parent);
+		if os.IsNotExist(err) {
+			// removed along with another file
+			return nil
+		}
 		if empty {
 			err = os.Remove(parent)
 		}
@@ -211,6 +229,23 @@ func RemoveWithDirs(path string, basePath string) (err error) {
 }
 
 func (store *ShardedFileStore) Terminate(id string) error {
+	held, err := store.IsHeld(id)
+	if err != nil {
+		return err
+	}
+	if held {
+		return ErrUploadHeld
+	}
+
+	// other uploads of the same .bin may be terminated or finished concurrently
+	hash, _, err := store.lookupHash(id)
+	if err != nil {
+		return err
+	}
+	if hash != nil {
+		defer store.hashLocks.lock(hash)()
+	}
+
 	duplicates, err := store.getDuplicateCount(id)
 	if err != nil {
 		return err
@@ -356,7 +391,7 @@ func (store *ShardedFileStore) incompleteBinPath(id string) string {
 	return filepath.Join(store.incompleteBinDir(), id+".bin")
 }
 
-func (store ShardedFileStore) completeBinPath(hashBytes []byte) string {
+func (store *ShardedFileStore) completeBinPath(hashBytes []byte) string {
 	// finished: <base-path>/complete/<hash-shards>/<hash>.bin
 	hash := fmt.Sprintf("%x", hashBytes)
 	shards := store.shards(hash)
@@ -405,8 +440,17 @@ func (store *ShardedFileStore) writeInfo(id string, info tusd.FileInfo) error {
 	return ioutil.WriteFile(store.infoPath(id), data, defaultFilePerm)
 }
 
+// ErrDrained occurs when finishing an upload after the store has been drained for shutdown
+var ErrDrained = tusd.NewHTTPError(errors.New("Server is shutting down"), http.StatusServiceUnavailable)
+
 // FinishUpload deduplicates the upload by its cryptographic hash
 func (store *ShardedFileStore) FinishUpload(id string) error {
+	store.finishMu.RLock()
+	defer store.finishMu.RUnlock()
+	if store.drained {
+		return ErrDrained
+	}
+
 	store.log.Debug().
 		Str("event", "upload_finished").
 		Str("id", id).Msg("Finishing upload")
@@ -416,6 +460,7 @@ func (store *ShardedFileStore) FinishUpload(id string) error {
 	if err != nil {
 		return err
 	}
+	defer store.hashLocks.lock(hash)()
 
 	// update hash in uploads table
 	err = db.UpdateRow(store.DBConn.DB, `
@@ -442,6 +487,14 @@ func (store *ShardedFileStore) FinishUpload(id string) error {
 	return err
 }
 
+// Drain waits for uploads being finished to complete. Uploads can no longer be finished
+// afterwards, allowing the database to be closed.
+func (store *ShardedFileStore) Drain() {
+	store.finishMu.Lock()
+	defer store.finishMu.Unlock()
+	store.drained = true
+}
+
 func (store *ShardedFileStore) hashFile(id string) ([]byte, error) {
 	f, err := os.Open(store.binPath(id))
 	if err != nil {
@@ -457,6 +510,19 @@ func (store *ShardedFileStore) hashFile(id string) ([]byte, error) {
 	return h.Sum(nil), nil
 }
 
+// MimeType returns the MIME type declared in the metadata of an upload
+func MimeType(metadata map[string]string) string {
+	if mimeType := metadata["type"]; mimeType != "" {
+		return mimeType
+	}
+	return metadata["filetype"]
+}
+
+// nullString maps empty strings to NULL
+func nullString(str string) sql.NullString {
+	return sql.NullString{String: str, Valid: str != ""}
+}
+
 func isDirEmpty(path string) (bool, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -0,0 +1,98 @@
+package shardedfilestore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/rs/zerolog"
+	"github.com/tus/tusd"
+)
+
+// newTestStore creates a store in a temporary directory, which cleanup removes
+func newTestStore(t *testing.T) (store *ShardedFileStore, cleanup func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "shardedfilestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := zerolog.Nop()
+	dbConn := db.ConnectToDB(&log, db.DBConfig{
+		DriverName: "sqlite3",
+		DSN:        filepath.Join(dir, "uploads.db"),
+	})
+	store = New(filepath.Join(dir, "uploads"), 2, dbConn, &log)
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// finishedUpload stores data as a new upload and finishes it
+func finishedUpload(t *testing.T, store *ShardedFileStore, data []byte) string {
+	t.Helper()
+	id, err := store.NewUpload(tusd.FileInfo{Size: int64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteChunk(id, 0, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.FinishUpload(id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestTerminateDuplicates(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	data := []byte("deduplicated")
+	first := finishedUpload(t, store, data)
+	second := finishedUpload(t, store, data)
+	binPath := store.binPath(first)
+
+	if err := store.Terminate(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(binPath); err != nil {
+		t.Fatalf("expected the .bin to be kept for the other upload, got %v", err)
+	}
+	if err := store.Terminate(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(binPath); !os.IsNotExist(err) {
+		t.Errorf("expected the .bin to be removed with the last upload, got %v", err)
+	}
+}
+
+func TestTerminateDuplicatesInParallel(t *testing.T) {
+	store, cleanup := newTestStore(t)
+	defer cleanup()
+	for i := 0; i < 20; i++ {
+		data := []byte{byte(i)}
+		ids := []string{finishedUpload(t, store, data), finishedUpload(t, store, data)}
+		binPath := store.binPath(ids[0])
+
+		var wg sync.WaitGroup
+		for _, id := range ids {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				if err := store.Terminate(id); err != nil {
+					t.Error(err)
+				}
+			}(id)
+		}
+		wg.Wait()
+
+		if _, err := os.Stat(binPath); !os.IsNotExist(err) {
+			t.Fatalf("expected the .bin to be removed once both uploads are terminated, got %v", err)
+		}
+	}
+}
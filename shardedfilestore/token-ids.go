@@ -0,0 +1,39 @@
+package shardedfilestore
+
+import (
+	"time"
+)
+
+// ClaimTokenID records the jti of a token until it expires. Returns false if the jti
+// was already recorded for the issuer, meaning the token is being replayed.
+func (store *ShardedFileStore) ClaimTokenID(issuer, jti string, expiresAt time.Time) (fresh bool, err error) {
+	_, err = store.DBConn.DB.Exec(`
+		INSERT INTO used_token_ids(issuer, jti, expires_at)
+		VALUES (?, ?, ?)
+	`, issuer, jti, expiresAt.Unix())
+	if err == nil {
+		return true, nil
+	}
+
+	// the insert fails on the primary key if the jti has been seen before
+	var count int
+	countErr := store.DBConn.DB.Get(&count, `
+		SELECT COUNT(*) FROM used_token_ids
+		WHERE issuer = ? AND jti = ?
+	`, issuer, jti)
+	if countErr == nil && count > 0 {
+		return false, nil
+	}
+	return false, err
+}
+
+// PurgeTokenIDs forgets the recorded jti of tokens that expired before the given time
+func (store *ShardedFileStore) PurgeTokenIDs(before time.Time) (int64, error) {
+	result, err := store.DBConn.DB.Exec(`
+		DELETE FROM used_token_ids WHERE expires_at < ?
+	`, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
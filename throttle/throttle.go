@@ -0,0 +1,156 @@
+// Package throttle limits the bandwidth of readers and writers using token buckets,
+// where a token is one byte. Several limiters can apply at once, such as a global one
+// shared by all connections and another for a single connection.
+package throttle
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// NewLimiter creates a limiter for the given number of bytes per second, allowing
+// bursts of up to one second. Returns nil when bytesPerSecond is zero.
+func NewLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burstFor(bytesPerSecond))
+}
+
+// SetLimit changes the limit of a shared limiter in place, zero disables it
+func SetLimit(limiter *rate.Limiter, bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		limiter.SetLimit(rate.Inf)
+		return
+	}
+	limiter.SetLimit(rate.Limit(bytesPerSecond))
+	limiter.SetBurst(burstFor(bytesPerSecond))
+}
+
+func burstFor(bytesPerSecond int64) int {
+	const maxBurst = 1 << 30
+	if bytesPerSecond > maxBurst {
+		return maxBurst
+	}
+	return int(bytesPerSecond)
+}
+
+// active drops nil and unlimited limiters
+func active(limiters []*rate.Limiter) []*rate.Limiter {
+	var result []*rate.Limiter
+	for _, limiter := range limiters {
+		if limiter != nil && limiter.Limit() != rate.Inf {
+			result = append(result, limiter)
+		}
+	}
+	return result
+}
+
+// maxChunk is the largest amount of bytes all limiters can grant at once
+func maxChunk(limiters []*rate.Limiter, size int) int {
+	for _, limiter := range limiters {
+		if burst := limiter.Burst(); burst < size {
+			size = burst
+		}
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+func wait(ctx context.Context, limiters []*rate.Limiter, n int) error {
+	for _, limiter := range limiters {
+		if err := waitN(ctx, limiter, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitN waits for n tokens in chunks of the current burst, as a reload can lower the
+// burst of a shared limiter after the size of a read was chosen
+func waitN(ctx context.Context, limiter *rate.Limiter, n int) error {
+	retried := false
+	for n > 0 {
+		chunk := maxChunk([]*rate.Limiter{limiter}, n)
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			// the burst may have been lowered between reading and using it
+			if !retried && ctx.Err() == nil && chunk > limiter.Burst() {
+				retried = true
+				continue
+			}
+			return err
+		}
+		retried = false
+		n -= chunk
+	}
+	return nil
+}
+
+type reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rate.Limiter
+}
+
+// NewReader returns a reader that reads from r no faster than all the limiters allow.
+// Waiting is aborted when ctx is done. nil limiters are ignored.
+func NewReader(ctx context.Context, r io.Reader, limiters ...*rate.Limiter) io.Reader {
+	limiters = active(limiters)
+	if len(limiters) == 0 {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return r.r.Read(p)
+	}
+
+	p = p[:maxChunk(r.limiters, len(p))]
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := wait(r.ctx, r.limiters, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type writer struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+// NewWriter returns a writer that writes to w no faster than all the limiters allow.
+// Waiting is aborted when ctx is done. nil limiters are ignored.
+func NewWriter(ctx context.Context, w io.Writer, limiters ...*rate.Limiter) io.Writer {
+	limiters = active(limiters)
+	if len(limiters) == 0 {
+		return w
+	}
+	return &writer{ctx: ctx, w: w, limiters: limiters}
+}
+
+func (w *writer) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		chunk := p[:maxChunk(w.limiters, len(p))]
+		if err = wait(w.ctx, w.limiters, len(chunk)); err != nil {
+			return
+		}
+
+		var n int
+		n, err = w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return
+		}
+		p = p[n:]
+	}
+	return
+}
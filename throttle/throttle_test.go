@@ -0,0 +1,178 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const kb = 1 << 10
+
+// zeros is an endless reader
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// checkDuration fails unless elapsed is close to expected. The upper bound is loose, as
+// slow test machines only ever make transfers slower.
+func checkDuration(t *testing.T, elapsed, expected time.Duration) {
+	t.Helper()
+	if elapsed < expected*8/10 || elapsed > expected*2+500*time.Millisecond {
+		t.Errorf("took %v, expected about %v", elapsed, expected)
+	}
+}
+
+func readAll(t *testing.T, size int64, limiters ...*rate.Limiter) time.Duration {
+	t.Helper()
+	start := time.Now()
+	r := NewReader(context.Background(), io.LimitReader(zeros{}, size), limiters...)
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size {
+		t.Fatalf("read %d bytes, expected %d", n, size)
+	}
+	return time.Since(start)
+}
+
+func writeAll(t *testing.T, size int64, limiters ...*rate.Limiter) time.Duration {
+	t.Helper()
+	start := time.Now()
+	w := NewWriter(context.Background(), ioutil.Discard, limiters...)
+	n, err := w.Write(make([]byte, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(n) != size {
+		t.Fatalf("wrote %d bytes, expected %d", n, size)
+	}
+	return time.Since(start)
+}
+
+// Each case transfers a burst for free and then one second at the slowest rate
+var rateCases = []struct {
+	name     string
+	size     int64
+	limiters func() []*rate.Limiter
+}{
+	{
+		name: "global",
+		size: 128 * kb,
+		limiters: func() []*rate.Limiter {
+			return []*rate.Limiter{NewLimiter(64 * kb), nil}
+		},
+	},
+	{
+		name: "per connection below global",
+		size: 64 * kb,
+		limiters: func() []*rate.Limiter {
+			return []*rate.Limiter{NewLimiter(1 << 20), NewLimiter(32 * kb)}
+		},
+	},
+	{
+		name: "identified above per connection",
+		size: 256 * kb,
+		limiters: func() []*rate.Limiter {
+			return []*rate.Limiter{NewLimiter(1 << 20), NewLimiter(128 * kb)}
+		},
+	},
+}
+
+func TestReaderRates(t *testing.T) {
+	for _, tc := range rateCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checkDuration(t, readAll(t, tc.size, tc.limiters()...), time.Second)
+		})
+	}
+}
+
+func TestWriterRates(t *testing.T) {
+	for _, tc := range rateCases {
+		t.Run(tc.name, func(t *testing.T) {
+			checkDuration(t, writeAll(t, tc.size, tc.limiters()...), time.Second)
+		})
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	unlimited := rate.NewLimiter(rate.Inf, 0)
+	if elapsed := readAll(t, 64<<20, unlimited, NewLimiter(0)); elapsed > time.Second {
+		t.Errorf("unlimited read took %v", elapsed)
+	}
+	if elapsed := writeAll(t, 64<<20, unlimited, NewLimiter(0)); elapsed > time.Second {
+		t.Errorf("unlimited write took %v", elapsed)
+	}
+}
+
+func TestGlobalShared(t *testing.T) {
+	global := NewLimiter(64 * kb)
+
+	// both connections are well under their own caps, but share the global one
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := NewReader(context.Background(), io.LimitReader(zeros{}, 64*kb), global, NewLimiter(1<<20))
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	checkDuration(t, time.Since(start), time.Second)
+}
+
+// reloadingReader lowers the limit of a shared limiter during a read, like a reload
+type reloadingReader struct {
+	limiter *rate.Limiter
+	once    sync.Once
+}
+
+func (r *reloadingReader) Read(p []byte) (int, error) {
+	r.once.Do(func() { SetLimit(r.limiter, 16*kb) })
+	return zeros{}.Read(p)
+}
+
+func TestBurstLoweredDuringRead(t *testing.T) {
+	global := NewLimiter(1 << 20)
+	r := NewReader(context.Background(), &reloadingReader{limiter: global}, global)
+
+	// the read is sized for the old burst, and must be waited for at the new rate
+	start := time.Now()
+	n, err := r.Read(make([]byte, 32*kb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 32*kb {
+		t.Fatalf("read %d bytes, expected %d", n, 32*kb)
+	}
+	checkDuration(t, time.Since(start), time.Second)
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := NewReader(ctx, zeros{}, NewLimiter(kb))
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := io.Copy(ioutil.Discard, r)
+	if err == nil {
+		t.Fatal("expected an error once cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("cancelled read took %v", elapsed)
+	}
+}
@@ -3,18 +3,225 @@ package main
 // symlink or copy this file into your webircgateway/plugins/fileuploader/plugin.go
 
 import (
+	"errors"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/kiwiirc/plugin-fileuploader/server"
 	"github.com/kiwiirc/webircgateway/pkg/webircgateway"
+	"github.com/rs/zerolog"
+	"gopkg.in/ini.v1"
 )
 
+// pluginSettings are read from the [fileuploader] section of the webircgateway config:
+//
+//	[fileuploader]
+//	config = fileuploader.config.toml
+//	log_to_gateway = true
+//	discover_issuers = true
+type pluginSettings struct {
+	configPath      string
+	logToGateway    bool
+	discoverIssuers bool
+}
+
+// closeTimeout bounds how long the gateway.closing hook waits for the server to stop
+const closeTimeout = time.Minute
+
 func Start(gateway *webircgateway.Gateway, pluginsQuit *sync.WaitGroup) {
 	gateway.Log(1, "Starting fileuploader-server plugin. webircgateway version: %s", webircgateway.Version)
 
+	// this version of webircgateway has no hook for its reloads, so the settings are only
+	// read on startup
+	settings := loadPluginSettings(gateway)
+	gateway.Log(2, "fileuploader: using config %s", settings.configPath)
+
+	runCtx := server.NewRunContext(gateway.HttpRouter, settings.configPath)
+	stopped := make(chan struct{})
+
+	// the gateway owns the process signals, and waits for plugins in gateway.closing
+	runCtx.SetSignalHandling(false)
+	webircgateway.HookRegister("gateway.closing", func(hook *webircgateway.HookGatewayClosing) {
+		runCtx.Shutdown()
+		select {
+		case <-stopped:
+		case <-time.After(closeTimeout):
+			gateway.Log(3, "fileuploader: not stopped after %s, closing anyway", closeTimeout)
+		}
+	})
+
+	if settings.discoverIssuers {
+		runCtx.SetIssuerDiscovery(func() map[string]string {
+			return gatewayIssuers(gateway)
+		})
+	}
+
+	clients := newClientRegistry()
+	runCtx.SetAnnouncer(clients.announce)
+
+	if settings.logToGateway {
+		runCtx.SetLogFunc(func(level zerolog.Level, line string) {
+			gateway.Log(gatewayLogLevel(level), "fileuploader: %s", line)
+		})
+	}
+
 	go func() {
 		defer pluginsQuit.Done()
-		s := server.NewRunContext(gateway.HttpRouter, "fileuploader.config.toml")
-		s.Run()
+		defer close(stopped)
+		if err := runCtx.Run(); err != nil {
+			gateway.Log(3, "fileuploader-server not started: %s", err.Error())
+		}
 	}()
 }
+
+// loadPluginSettings reads the [fileuploader] section of the gateway config. Relative
+// paths given there are resolved from the directory of the gateway config.
+func loadPluginSettings(gateway *webircgateway.Gateway) pluginSettings {
+	// relative to the working directory, as before the path was configurable
+	settings := pluginSettings{
+		configPath:      "fileuploader.config.toml",
+		discoverIssuers: true,
+	}
+
+	// configs produced by a command ("$ ...") are not read a second time
+	configFile := gateway.Config.CurrentConfigFile()
+	if strings.HasPrefix(configFile, "$ ") {
+		return settings
+	}
+
+	cfg, err := ini.LoadSources(ini.LoadOptions{AllowBooleanKeys: true}, configFile)
+	if err != nil {
+		gateway.Log(3, "fileuploader: failed to read the gateway config: %s", err.Error())
+		return settings
+	}
+
+	section := cfg.Section("fileuploader")
+	if path := section.Key("config").String(); path != "" {
+		settings.configPath = gateway.Config.ResolvePath(path)
+	}
+	settings.logToGateway = section.Key("log_to_gateway").MustBool(false)
+	settings.discoverIssuers = section.Key("discover_issuers").MustBool(true)
+	return settings
+}
+
+// gatewayIssuers returns the issuers of the EXTJWT tokens the gateway signs for clients
+// of its configured upstreams, when the upstream does not support EXTJWT itself. Tokens
+// are issued by the network_common_address of the upstream, or else its hostname, and
+// signed with the secret of the gateway. Upstreams chosen by clients in gateway mode are
+// not known in advance.
+func gatewayIssuers(gateway *webircgateway.Gateway) map[string]string {
+	secret := gateway.Config.Secret
+	if secret == "" {
+		// tokens signed with an empty secret could be forged by anyone
+		return nil
+	}
+
+	issuers := make(map[string]string)
+	for _, upstream := range gateway.Config.Upstreams {
+		issuers[upstreamIssuer(&upstream)] = secret
+	}
+	return issuers
+}
+
+// upstreamIssuer is the issuer of the tokens the gateway signs for clients of upstream
+func upstreamIssuer(upstream *webircgateway.ConfigUpstream) string {
+	if upstream.NetworkCommonAddress != "" {
+		return upstream.NetworkCommonAddress
+	}
+	return upstream.Hostname
+}
+
+// errAnnouncerNotConnected occurs when the uploader has no connection through the gateway
+// that is still in the channel
+var errAnnouncerNotConnected = errors.New("Uploader is not connected to the channel through the gateway")
+
+// clientIdentity is the issuer and nick of a client registered upstream
+type clientIdentity struct {
+	issuer string
+	nick   string
+}
+
+// clientRegistry tracks the identities of gateway clients. The gateway updates the
+// state of a client without locking, from the goroutine that handles its lines, so
+// that state is only read in the irc.line hook dispatched by that goroutine.
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients map[*webircgateway.Client]clientIdentity
+}
+
+func newClientRegistry() *clientRegistry {
+	registry := &clientRegistry{clients: make(map[*webircgateway.Client]clientIdentity)}
+	webircgateway.HookRegister("irc.line", registry.observeLine)
+	webircgateway.HookRegister("client.state", func(hook *webircgateway.HookClientState) {
+		if !hook.Connected {
+			registry.mu.Lock()
+			delete(registry.clients, hook.Client)
+			registry.mu.Unlock()
+		}
+	})
+	return registry
+}
+
+// observeLine follows registration and nick changes like the gateway does, as the hook
+// runs before the gateway processes the line
+func (registry *clientRegistry) observeLine(hook *webircgateway.HookIrcLine) {
+	message := hook.Message
+	if hook.ToServer || message == nil || len(message.Params) == 0 {
+		return
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	identity, registered := registry.clients[hook.Client]
+	switch {
+	case message.Command == "001":
+		identity.issuer = upstreamIssuer(hook.UpstreamConfig)
+		identity.nick = message.Params[0]
+	case registered && message.Command == "NICK" && message.Prefix != nil && message.Prefix.Nick == identity.nick:
+		identity.nick = message.Params[0]
+	default:
+		return
+	}
+	registry.clients[hook.Client] = identity
+}
+
+// announce sends the announcement upstream on the connection of the uploader, which
+// must still be in the channel
+func (registry *clientRegistry) announce(announcement server.Announcement) error {
+	registry.mu.Lock()
+	var candidates []*webircgateway.Client
+	for client, identity := range registry.clients {
+		if identity.issuer == announcement.Issuer && strings.EqualFold(identity.nick, announcement.Nick) {
+			candidates = append(candidates, client)
+		}
+	}
+	registry.mu.Unlock()
+
+	for _, client := range candidates {
+		// the channels of a client are guarded by the gateway
+		if !client.IrcState.HasChannel(announcement.Channel) {
+			continue
+		}
+
+		// the line worker of the client writes it upstream, without blocking here
+		select {
+		case client.UpstreamSend <- announcement.Line:
+			return nil
+		default:
+			return errors.New("Send queue of the uploader's connection is full")
+		}
+	}
+	return errAnnouncerNotConnected
+}
+
+// gatewayLogLevel maps zerolog levels to the debug, info and warning levels of gateway.Log
+func gatewayLogLevel(level zerolog.Level) int {
+	switch {
+	case level <= zerolog.DebugLevel:
+		return 1
+	case level == zerolog.InfoLevel, level == zerolog.NoLevel:
+		return 2
+	}
+	return 3
+}